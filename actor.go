@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// HEADER_USER names who sends the request, it is saved in createdBy and updatedBy.
+const HEADER_USER = "X-User"
+
+type actorKey struct{}
+
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, strings.TrimSpace(actor))
+}
+
+// actorFrom returns the user of the request, empty if it didn't say.
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+func actorHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(withActor(r.Context(), r.Header.Get(HEADER_USER))))
+	}
+}
+
+// actorUnaryInterceptor reads the user from the x-user metadata of the gRPC calls.
+func actorUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(HEADER_USER); len(values) > 0 {
+			ctx = withActor(ctx, values[0])
+		}
+	}
+	return handler(ctx, req)
+}
+
+// now is the time saved in the timestamps, truncated like in MongoDB.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"mongo-http-audit-service/src/myLogger"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+)
+
+var ErrCircuitOpen = errors.New("storage unavailable, circuit breaker open")
+
+// circuitOpenError is ErrCircuitOpen with the time until the next trial.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s, retry in %s", ErrCircuitOpen.Error(), e.retryAfter.Round(time.Second))
+}
+
+func (e *circuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// circuitBreaker fails fast once the store failed threshold times in a row. It stays open for openDuration, then
+// lets halfOpenTrials calls through: it closes when they all succeed and opens again on the first failure.
+type circuitBreaker struct {
+	threshold      int
+	openDuration   time.Duration
+	halfOpenTrials int
+	now            func() time.Time
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	trials    int
+	successes int
+
+	// Totals for the metrics
+	openedCount   int64
+	rejectedCount int64
+	failureCount  int64
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration, halfOpenTrials int) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, openDuration: openDuration, halfOpenTrials: halfOpenTrials, now: time.Now, state: BREAKER_CLOSED}
+}
+
+// allow returns whether a call can go through, and if it is a trial of the half-open state. When it can't,
+// retryAfter is the time until the next trial.
+func (b *circuitBreaker) allow() (ok bool, trial bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BREAKER_OPEN {
+		if remaining := b.openedAt.Add(b.openDuration).Sub(b.now()); remaining > 0 {
+			b.rejectedCount++
+			return false, false, remaining
+		}
+		b.setState(BREAKER_HALF_OPEN)
+		b.trials, b.successes = 0, 0
+	}
+	if b.state == BREAKER_HALF_OPEN {
+		if b.trials >= b.halfOpenTrials {
+			b.rejectedCount++
+			return false, false, b.openDuration
+		}
+		b.trials++
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// done records the result of a call that allow let through.
+func (b *circuitBreaker) done(trial bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failed {
+		b.failureCount++
+	}
+	switch b.state {
+	case BREAKER_CLOSED:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	case BREAKER_HALF_OPEN:
+		// The calls started before the breaker opened don't count
+		if !trial {
+			return
+		}
+		b.trials--
+		if failed {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.halfOpenTrials {
+			b.failures = 0
+			b.setState(BREAKER_CLOSED)
+		}
+	}
+}
+
+// release gives back a trial that ended without telling anything about the store.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BREAKER_HALF_OPEN {
+		b.trials--
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.openedCount++
+	b.setState(BREAKER_OPEN)
+}
+
+func (b *circuitBreaker) setState(state string) {
+	if b.state != state {
+		myLogger.For("breaker").Warn().Msgf("[Breaker] Circuit breaker %s", state)
+	}
+	b.state = state
+}
+
+// breakerStats is the state of the breaker in the health details and the metrics.
+type breakerStats struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	Opened              int64  `json:"opened"`
+	Rejected            int64  `json:"rejected"`
+	Failures            int64  `json:"failures"`
+}
+
+func (b *circuitBreaker) stats() breakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStats{State: b.state, ConsecutiveFailures: b.failures, Opened: b.openedCount, Rejected: b.rejectedCount, Failures: b.failureCount}
+}
+
+// isStoreFailure returns true for the errors telling that the storage is unavailable. The other errors (not found,
+// conflicts...) are answers of the storage, and a request canceled by its client says nothing about it.
+func isStoreFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsNetworkError(err) || mongo.IsTimeout(err) ||
+		errors.As(err, &topology.ServerSelectionError{})
+}
+
+// circuitOpenResponse answers 503 with Retry-After when err comes from the open breaker. It returns false for the
+// other errors, that the handler answers itself.
+func circuitOpenResponse(w http.ResponseWriter, err error) bool {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(open.retryAfter, time.Second).Seconds()))))
+	http.Error(w, "Error: "+err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// breakerStore sends the calls of the handlers through the breaker. Ping isn't guarded so /health shows the storage
+// itself.
+type breakerStore struct {
+	documents DocumentStore
+	batches   BatchStore
+	breaker   *circuitBreaker
+}
+
+func newBreakerStore(documents DocumentStore, batches BatchStore, breaker *circuitBreaker) *breakerStore {
+	return &breakerStore{documents: documents, batches: batches, breaker: breaker}
+}
+
+// call runs fn if the breaker allows it. A request already canceled doesn't take a trial of the half-open breaker,
+// and a trial canceled during fn is given back without closing it.
+func (s *breakerStore) call(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ok, trial, retryAfter := s.breaker.allow()
+	if !ok {
+		return &circuitOpenError{retryAfter: retryAfter}
+	}
+	err := fn()
+	if trial && errors.Is(err, context.Canceled) {
+		s.breaker.release()
+		return err
+	}
+	s.breaker.done(trial, isStoreFailure(err))
+	return err
+}
+
+func (s *breakerStore) Ping(ctx context.Context) error {
+	return s.documents.Ping(ctx)
+}
+
+func (s *breakerStore) InsertDocument(ctx context.Context, doc *MyDocument) error {
+	return s.call(ctx, func() error {
+		return s.documents.InsertDocument(ctx, doc)
+	})
+}
+
+// InsertDocuments counts as one call, failed if one of the documents failed like the storage does.
+func (s *breakerStore) InsertDocuments(ctx context.Context, docs []*MyDocument) []error {
+	var res []error
+	err := s.call(ctx, func() error {
+		res = s.documents.InsertDocuments(ctx, docs)
+		for _, err := range res {
+			if isStoreFailure(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && res == nil {
+		res = make([]error, len(docs))
+		for i := range res {
+			res[i] = err
+		}
+	}
+	return res
+}
+
+func (s *breakerStore) FindDocument(ctx context.Context, key string) (*MyDocument, error) {
+	var res *MyDocument
+	err := s.call(ctx, func() (err error) {
+		res, err = s.documents.FindDocument(ctx, key)
+		return err
+	})
+	return res, err
+}
+
+func (s *breakerStore) UpdateState(ctx context.Context, key string, fromState string, version int64, change StateChange) (*UpdateResult, error) {
+	var res *UpdateResult
+	err := s.call(ctx, func() (err error) {
+		res, err = s.documents.UpdateState(ctx, key, fromState, version, change)
+		return err
+	})
+	return res, err
+}
+
+func (s *breakerStore) UpdateDocument(ctx context.Context, key string, version int64, update DocumentUpdate) (*UpdateResult, error) {
+	var res *UpdateResult
+	err := s.call(ctx, func() (err error) {
+		res, err = s.documents.UpdateDocument(ctx, key, version, update)
+		return err
+	})
+	return res, err
+}
+
+func (s *breakerStore) FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error) {
+	var res []MyDocument
+	err := s.call(ctx, func() (err error) {
+		res, err = s.documents.FindDocuments(ctx, query)
+		return err
+	})
+	return res, err
+}
+
+func (s *breakerStore) UpdateStates(ctx context.Context, updates []StateUpdate) ([]string, error) {
+	var res []string
+	err := s.call(ctx, func() (err error) {
+		res, err = s.documents.UpdateStates(ctx, updates)
+		return err
+	})
+	return res, err
+}
+
+func (s *breakerStore) ProcessDocuments(ctx context.Context, keys []string, fromStates []string, updatedBy string) (*UpdateResult, []string, error) {
+	var res *UpdateResult
+	var updated []string
+	err := s.call(ctx, func() (err error) {
+		res, updated, err = s.documents.ProcessDocuments(ctx, keys, fromStates, updatedBy)
+		return err
+	})
+	return res, updated, err
+}
+
+func (s *breakerStore) InsertBatch(ctx context.Context, batch *MyDocumentList) error {
+	return s.call(ctx, func() error {
+		return s.batches.InsertBatch(ctx, batch)
+	})
+}
+
+func (s *breakerStore) FindBatch(ctx context.Context, id primitive.ObjectID) (*MyDocumentList, error) {
+	var res *MyDocumentList
+	err := s.call(ctx, func() (err error) {
+		res, err = s.batches.FindBatch(ctx, id)
+		return err
+	})
+	return res, err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(2, 10*time.Second, 1)
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, trial, _ := breaker.allow()
+		if !ok || trial {
+			t.Fatalf("expected: call allowed while closed, got: ok %v, trial %v", ok, trial)
+		}
+		breaker.done(trial, true)
+	}
+	if state := breaker.stats().State; state != BREAKER_OPEN {
+		t.Fatalf("expected: %s, got: %s", BREAKER_OPEN, state)
+	}
+	if ok, _, retryAfter := breaker.allow(); ok || retryAfter != 10*time.Second {
+		t.Fatalf("expected: rejected for 10s, got: ok %v, retry after %s", ok, retryAfter)
+	}
+
+	// Half-open: one trial, failing opens again
+	now = now.Add(10 * time.Second)
+	ok, trial, _ := breaker.allow()
+	if !ok || !trial {
+		t.Fatalf("expected: trial allowed, got: ok %v, trial %v", ok, trial)
+	}
+	if ok, _, _ := breaker.allow(); ok {
+		t.Fatalf("expected: second trial rejected, got: allowed")
+	}
+	breaker.done(trial, true)
+	if state := breaker.stats().State; state != BREAKER_OPEN {
+		t.Fatalf("expected: %s, got: %s", BREAKER_OPEN, state)
+	}
+
+	// A successful trial closes it
+	now = now.Add(10 * time.Second)
+	ok, trial, _ = breaker.allow()
+	breaker.done(trial, false)
+	stats := breaker.stats()
+	if !ok || stats.State != BREAKER_CLOSED || stats.Opened != 2 || stats.Rejected != 2 || stats.Failures != 3 {
+		t.Fatalf("expected: closed after opening 2 times, got: %+v", stats)
+	}
+}
+
+func TestBreakerCanceledTrial(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(1, 10*time.Second, 1)
+	breaker.now = func() time.Time { return now }
+	store := newBreakerStore(newMemoryStore(), nil, breaker)
+
+	breaker.allow()
+	breaker.done(false, true)
+	now = now.Add(10 * time.Second)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.FindDocument(canceled, "key"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected: %v, got: %v", context.Canceled, err)
+	}
+	// Canceled during the call
+	err := store.call(context.Background(), func() error { return context.Canceled })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected: %v, got: %v", context.Canceled, err)
+	}
+	if state := breaker.stats().State; state != BREAKER_HALF_OPEN {
+		t.Fatalf("expected: %s, got: %s", BREAKER_HALF_OPEN, state)
+	}
+
+	// The trial is still available
+	if _, err := store.FindDocument(context.Background(), "key"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+	if state := breaker.stats().State; state != BREAKER_CLOSED {
+		t.Fatalf("expected: %s, got: %s", BREAKER_CLOSED, state)
+	}
+}
+
+func TestIsStoreFailure(t *testing.T) {
+	for _, err := range []error{ErrNotFound, ErrDuplicateKey, ErrVersionMismatch, context.Canceled, nil} {
+		if isStoreFailure(err) {
+			t.Fatalf("expected: %v not counted as a failure, got: failure", err)
+		}
+	}
+	if !isStoreFailure(context.DeadlineExceeded) {
+		t.Fatalf("expected: %v counted as a failure, got: not a failure", context.DeadlineExceeded)
+	}
+}
+
+// unavailableStore fails like an unreachable Mongo.
+type unavailableStore struct {
+	*memoryStore
+	calls int
+}
+
+func (s *unavailableStore) InsertDocument(ctx context.Context, doc *MyDocument) error {
+	s.calls++
+	return context.DeadlineExceeded
+}
+
+func TestBreakerHandler(t *testing.T) {
+	store := &unavailableStore{memoryStore: newMemoryStore()}
+	ctx := &serverContext{events: newEventBroker(1), breaker: newCircuitBreaker(2, time.Minute, 1)}
+	breakers := newBreakerStore(store, store, ctx.breaker)
+	ctx.documents, ctx.batches = breakers, breakers
+	server := httptest.NewServer(ctx.MainServer(true))
+	defer server.Close()
+
+	doc := MyDocument{Name: "name", Key: "key"}
+	for i := 0; i < 2; i++ {
+		resp, body := doRequest(t, http.MethodPost, server.URL+"/save", doc)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/save", doc)
+	expectStatus(t, resp, body, http.StatusServiceUnavailable)
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "60" {
+		t.Fatalf("expected: Retry-After 60, got: %q", retryAfter)
+	}
+	if store.calls != 2 {
+		t.Fatalf("expected: 2 calls to the store, got: %d", store.calls)
+	}
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/documents/key", nil)
+	expectStatus(t, resp, body, http.StatusServiceUnavailable)
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter == "" {
+		t.Fatalf("expected: Retry-After, got: none")
+	}
+	// The errors of the requests themselves are kept
+	resp, body = doRequestWithHeader(t, http.MethodPut, server.URL+"/documents/key/state", StateChangeRequest{State: STATE_VERIFIED}, http.Header{"If-Match": {"not-an-etag"}})
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/health/details", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+	var details healthDetails
+	if err := json.Unmarshal(body, &details); err != nil {
+		t.Fatalf("Could not deserialized health details: %v", err)
+	}
+	if details.CircuitBreaker == nil || details.CircuitBreaker.State != BREAKER_OPEN {
+		t.Fatalf("expected: circuit breaker %s, got: %+v", BREAKER_OPEN, details)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/metrics", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+	for _, line := range []string{`audit_circuit_breaker_state{state="open"} 1`, "audit_circuit_breaker_rejected_total 2"} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("expected: %s in the metrics, got: %s", line, body)
+		}
+	}
+}
+
+func TestGrpcErrorCircuitOpen(t *testing.T) {
+	err := grpcError(fmt.Errorf("%w, retry in 10s", ErrCircuitOpen))
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Fatalf("expected: %v, got: %v", codes.Unavailable, code)
+	}
+}
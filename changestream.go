@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mongo-http-audit-service/src/myLogger"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ResumeTokenCollection = "changeStreamResumeTokens"
+
+type changeEvent struct {
+	ID            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	FullDocument  *MyDocument         `bson:"fullDocument"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	UpdateDescription struct {
+		UpdatedFields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+// toStateChangeEvent returns false if the change doesn't give a state to the document.
+func (e changeEvent) toStateChangeEvent() (StateChangeEvent, bool) {
+	event := StateChangeEvent{
+		DocumentID: e.DocumentKey.ID.Hex(),
+		Time:       time.Unix(int64(e.ClusterTime.T), 0).UTC(),
+	}
+	if data, ok := e.ID.Lookup("_data").StringValueOK(); ok {
+		event.ID = data
+	}
+
+	if e.OperationType == "update" {
+		state, ok := e.UpdateDescription.UpdatedFields["state"].(string)
+		if !ok {
+			return event, false
+		}
+		event.State = state
+	} else if e.FullDocument != nil {
+		event.State = e.FullDocument.State
+	}
+	if event.State == "" {
+		return event, false
+	}
+
+	// On update the full document is looked up afterwards, it can be missing if it was deleted meanwhile
+	if e.FullDocument != nil {
+		event.Key = e.FullDocument.Key
+		event.Tenant = e.FullDocument.TenantID
+	}
+	event.Type = documentEventType(event.State)
+	return event, true
+}
+
+// changeStreamWatcher publishes the state changes of documentCollection. The resume token of the last
+// published event is saved in Mongo so a restart continues where the previous process stopped.
+type changeStreamWatcher struct {
+	name   string
+	store  *mongoStore
+	sink   EventSink
+	retry  time.Duration
+	tokens *mongo.Collection
+}
+
+func newChangeStreamWatcher(name string, store *mongoStore, sink EventSink) *changeStreamWatcher {
+	return &changeStreamWatcher{
+		name:   name,
+		store:  store,
+		sink:   sink,
+		retry:  time.Second,
+		tokens: store.collection(ResumeTokenCollection),
+	}
+}
+
+func (w *changeStreamWatcher) loadResumeToken(ctx context.Context) (bson.Raw, error) {
+	var saved struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := w.tokens.FindOne(ctx, bson.M{"_id": w.name}).Decode(&saved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return saved.Token, err
+}
+
+func (w *changeStreamWatcher) saveResumeToken(ctx context.Context, token bson.Raw) error {
+	_, err := w.tokens.UpdateOne(ctx,
+		bson.M{"_id": w.name},
+		bson.M{"$set": bson.M{"token": token, "updatedAt": time.Now()}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// Run watches until ctx is done, reopening the stream after an error.
+func (w *changeStreamWatcher) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := w.watch(ctx); err != nil && ctx.Err() == nil {
+			myLogger.For("changestream").Error().Msgf("[Change stream] %s stopped: %s. Restarting in %s", w.name, err.Error(), w.retry)
+			select {
+			case <-ctx.Done():
+			case <-time.After(w.retry):
+			}
+		}
+	}
+}
+
+func (w *changeStreamWatcher) watch(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"operationType": bson.M{"$in": bson.A{"insert", "replace"}}},
+			bson.M{"operationType": "update", "updateDescription.updatedFields.state": bson.M{"$exists": true}},
+		}}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+
+	token, err := w.loadResumeToken(ctx)
+	if err != nil {
+		return err
+	}
+	if token != nil {
+		opts.SetResumeAfter(token)
+		myLogger.For("changestream").Info().Msgf("[Change stream] %s resumes from the saved token", w.name)
+	}
+
+	stream, err := w.store.collection(DocumentCollection).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var change changeEvent
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+		if event, ok := change.toStateChangeEvent(); ok {
+			if err := w.publish(ctx, event); err != nil {
+				return err
+			}
+		}
+		if err := w.saveResumeToken(ctx, stream.ResumeToken()); err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
+
+// publish retries until the sink accepted the event: the resume token must not move past an event that was not delivered.
+func (w *changeStreamWatcher) publish(ctx context.Context, event StateChangeEvent) error {
+	delay := w.retry
+	for {
+		err := w.sink.Publish(ctx, event)
+		if err == nil {
+			return nil
+		}
+		myLogger.For("changestream").Warn().Msgf("[Change stream] Could not publish event %s (%s): %s", event.Type, event.Key, err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, time.Minute)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const contentTypeMergePatch = "application/merge-patch+json"
+
+const defaultListingLimit = 100
+
+// HEADER_NEXT_AFTER_KEY is set on a full page of GET /documents, its value is the afterKey of the next page.
+const HEADER_NEXT_AFTER_KEY = "X-Next-After-Key"
+
+// maxBodyOverhead is the room left for the other fields of a document in its body, on top of maxPayloadSize.
+const maxBodyOverhead = 16 * 1024
+
+var (
+	ErrInvalidDocument = errors.New("invalid document")
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+var patchableFields = []string{"name", "payload", "labels"}
+
+// DocumentUpdate is what UpdateDocument replaces on the document.
+type DocumentUpdate struct {
+	Name      string
+	Payload   map[string]any
+	Labels    map[string]string
+	UpdatedBy string
+}
+
+// validateDocument checks the labels and the size of the payload once encoded in JSON (no limit if maxPayloadSize is 0).
+func (s *serverContext) validateDocument(payload map[string]any, labels map[string]string) error {
+	for label := range labels {
+		if label == "" || strings.Contains(label, ".") || strings.HasPrefix(label, "$") {
+			return fmt.Errorf("%w: invalid label name: %q", ErrInvalidDocument, label)
+		}
+	}
+	maxPayloadSize := s.runtime().maxPayloadSize
+	if maxPayloadSize > 0 && payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidDocument, err.Error())
+		}
+		if len(encoded) > maxPayloadSize {
+			return fmt.Errorf("%w: %d bytes (max: %d)", ErrPayloadTooLarge, len(encoded), maxPayloadSize)
+		}
+	}
+	return nil
+}
+
+// limitBody stops reading the body of a document after maxPayloadSize and its overhead (no limit if maxPayloadSize is
+// 0): the decoding then fails with an error for which isBodyTooLarge is true.
+func (s *serverContext) limitBody(w http.ResponseWriter, r *http.Request) {
+	if maxPayloadSize := s.runtime().maxPayloadSize; maxPayloadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxPayloadSize+maxBodyOverhead))
+	}
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// asObject also accepts the primitive.M decoded by the mongo driver.
+func asObject(value any) (map[string]any, bool) {
+	switch object := value.(type) {
+	case map[string]any:
+		return object, true
+	case primitive.M:
+		return object, true
+	default:
+		return nil, false
+	}
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) without modifying target.
+func mergePatch(target any, patch any) any {
+	patchObject, ok := asObject(patch)
+	if !ok {
+		return patch
+	}
+	res := map[string]any{}
+	if targetObject, ok := asObject(target); ok {
+		for field, value := range targetObject {
+			res[field] = value
+		}
+	}
+	for field, value := range patchObject {
+		if value == nil {
+			delete(res, field)
+		} else {
+			res[field] = mergePatch(res[field], value)
+		}
+	}
+	return res
+}
+
+// patchDocument applies the merge patch to the name, payload and labels of the document. It returns
+// ErrVersionMismatch if version is not 0 and the document is in another version.
+func (s *serverContext) patchDocument(ctx context.Context, key string, patch map[string]any, version int64) (*MyDocument, error) {
+	for field := range patch {
+		if !slices.Contains(patchableFields, field) {
+			return nil, fmt.Errorf("%w: %s can't be patched (expected: %s)", ErrInvalidDocument, field, strings.Join(patchableFields, ", "))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.runtime().writeTimeout)
+	defer cancel()
+
+	doc, err := s.documents.FindDocument(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && doc.Version != version {
+		return nil, fmt.Errorf("%w: expected version %d, got: %d", ErrVersionMismatch, version, doc.Version)
+	}
+
+	current, err := json.Marshal(map[string]any{"name": doc.Name, "payload": doc.Payload, "labels": doc.Labels})
+	if err != nil {
+		return nil, err
+	}
+	var target map[string]any
+	if err := json.Unmarshal(current, &target); err != nil {
+		return nil, err
+	}
+	patched, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return nil, err
+	}
+	var fields struct {
+		Name    string            `json:"name"`
+		Payload map[string]any    `json:"payload"`
+		Labels  map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal(patched, &fields); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDocument, err.Error())
+	}
+	if err := s.validateDocument(fields.Payload, fields.Labels); err != nil {
+		return nil, err
+	}
+
+	update := DocumentUpdate{Name: fields.Name, Payload: fields.Payload, Labels: fields.Labels, UpdatedBy: actorFrom(ctx)}
+	res, err := s.documents.UpdateDocument(ctx, key, doc.Version, update)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		if version != 0 {
+			return nil, fmt.Errorf("%w: %s changed during the update", ErrVersionMismatch, key)
+		}
+		return nil, fmt.Errorf("%w: %s changed during the update", ErrStateConflict, key)
+	}
+
+	updatedAt := now()
+	doc.Name, doc.Payload, doc.Labels = update.Name, update.Payload, update.Labels
+	doc.UpdatedAt, doc.UpdatedBy = &updatedAt, update.UpdatedBy
+	doc.Version++
+	return doc, nil
+}
+
+func (s *serverContext) patchDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, contentTypeMergePatch) && !strings.HasPrefix(contentType, "application/json") {
+		http.Error(w, "Error: expected Content-Type: "+contentTypeMergePatch, http.StatusUnsupportedMediaType)
+		return
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var patch map[string]any
+	s.limitBody(w, r)
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		if isBodyTooLarge(err) {
+			http.Error(w, "Error: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc, err := s.patchDocument(r.Context(), r.PathValue("key"), patch, version)
+	if err != nil {
+		switch {
+		case circuitOpenResponse(w, err):
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrInvalidDocument):
+			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrPayloadTooLarge):
+			http.Error(w, "Error: "+err.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, ErrStateConflict):
+			http.Error(w, "Error: "+err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrVersionMismatch):
+			http.Error(w, "Error: "+err.Error(), http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	setETag(w, doc)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// listDocumentsHandler lists the documents sorted by key, a page at a time.
+// Query parameters: state, namePrefix, label (name:value, can be repeated), limit (at most maxListingLimit) and
+// afterKey, the X-Next-After-Key header of the previous page.
+func (s *serverContext) listDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := DocumentQuery{State: strings.ToUpper(values.Get("state")), NamePrefix: values.Get("namePrefix"), AfterKey: values.Get("afterKey"), Limit: defaultListingLimit}
+	for _, label := range values["label"] {
+		name, value, ok := strings.Cut(label, ":")
+		if !ok || name == "" {
+			http.Error(w, "Error: invalid label filter (expected: name:value): "+label, http.StatusBadRequest)
+			return
+		}
+		if query.Labels == nil {
+			query.Labels = map[string]string{}
+		}
+		query.Labels[name] = value
+	}
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Error: invalid limit: "+limit, http.StatusBadRequest)
+			return
+		}
+		query.Limit = parsed
+	}
+	query.Limit = min(query.Limit, s.runtime().maxListingLimit)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.runtime().bulkTimeout)
+	defer cancel()
+	docs, err := s.documents.FindDocuments(ctx, query)
+	if err != nil {
+		if circuitOpenResponse(w, err) {
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A full page may not be the last one
+	if len(docs) == query.Limit {
+		w.Header().Set(HEADER_NEXT_AFTER_KEY, docs[len(docs)-1].Key)
+	}
+	json.NewEncoder(w).Encode(docs)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StateChangeEvent is the normalized event sent to the sinks when a document gets a new state.
+type StateChangeEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Key        string    `json:"key"`
+	DocumentID string    `json:"documentId,omitempty"`
+	State      string    `json:"state"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func newEventId() string {
+	return primitive.NewObjectID().Hex()
+}
+
+func documentEventType(state string) string {
+	return "document." + strings.ToLower(state)
+}
+
+// EventSink receives the state change events. Publish must return an error if the event was not delivered
+// so the caller can retry it.
+type EventSink interface {
+	Publish(ctx context.Context, event StateChangeEvent) error
+}
+
+// writerSink writes one JSON event per line (NDJSON).
+type writerSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func newWriterSink(writer io.Writer) *writerSink {
+	return &writerSink{writer: writer}
+}
+
+func (s *writerSink) Publish(ctx context.Context, event StateChangeEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+// webhookSink posts each event as JSON to an url.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (s *webhookSink) Publish(ctx context.Context, event StateChangeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered with status %d", s.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// multiSink publishes to every sink and fails if one of them failed.
+type multiSink []EventSink
+
+func (sinks multiSink) Publish(ctx context.Context, event StateChangeEvent) error {
+	var errs []error
+	for _, sink := range sinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newEventSinks builds the sinks from a comma separated list like: "stdout,file:/var/log/events.ndjson,webhook:http://host/events".
+func newEventSinks(config string) (multiSink, error) {
+	var sinks multiSink
+	for _, value := range strings.Split(config, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		kind, target, _ := strings.Cut(value, ":")
+		switch kind {
+		case "stdout":
+			sinks = append(sinks, newWriterSink(os.Stdout))
+		case "file":
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, newWriterSink(file))
+		case "webhook":
+			if target == "" {
+				return nil, fmt.Errorf("missing url for event sink: %s", value)
+			}
+			sinks = append(sinks, newWebhookSink(target))
+		default:
+			return nil, fmt.Errorf("unknown event sink: %s (expected: stdout, file:<path> or webhook:<url>)", value)
+		}
+	}
+	return sinks, nil
+}
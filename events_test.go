@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChangeEventNormalization(t *testing.T) {
+	id := primitive.NewObjectID()
+	token, _ := bson.Marshal(bson.M{"_data": "8263A1"})
+
+	update := changeEvent{ID: token, OperationType: "update", ClusterTime: primitive.Timestamp{T: 1700000000}, FullDocument: &MyDocument{Key: "key1", State: STATE_VERIFIED}}
+	update.DocumentKey.ID = id
+	update.UpdateDescription.UpdatedFields = bson.M{"state": STATE_VERIFIED}
+
+	event, ok := update.toStateChangeEvent()
+	if !ok {
+		t.Fatalf("expected: an event for a state update")
+	}
+	if event.ID != "8263A1" || event.Type != "document.verified" || event.Key != "key1" || event.DocumentID != id.Hex() || event.Time.Unix() != 1700000000 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	update.UpdateDescription.UpdatedFields = bson.M{"name": "other"}
+	if _, ok := update.toStateChangeEvent(); ok {
+		t.Fatalf("expected: no event for an update without state")
+	}
+
+	insert := changeEvent{ID: token, OperationType: "insert", FullDocument: &MyDocument{Key: "key2", State: STATE_INIT}}
+	if event, ok := insert.toStateChangeEvent(); !ok || event.Type != "document.init" || event.Key != "key2" {
+		t.Fatalf("unexpected event for an insert: %+v", event)
+	}
+}
+
+func TestEventSinks(t *testing.T) {
+	event := StateChangeEvent{ID: "1", Type: documentEventType(STATE_PROCESSED), Key: "key1", State: STATE_PROCESSED}
+
+	var buffer bytes.Buffer
+	if err := newWriterSink(&buffer).Publish(context.TODO(), event); err != nil {
+		t.Fatalf("Could not write event: %v", err)
+	}
+	var written StateChangeEvent
+	if err := json.Unmarshal(buffer.Bytes(), &written); err != nil || written.Key != "key1" || buffer.Bytes()[buffer.Len()-1] != '\n' {
+		t.Fatalf("expected: one json line, got: %s", buffer.String())
+	}
+
+	status := http.StatusOK
+	var received StateChangeEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := newWebhookSink(server.URL)
+	if err := sink.Publish(context.TODO(), event); err != nil || received.Type != "document.processed" {
+		t.Fatalf("expected: event to be received, got: %v (err: %v)", received, err)
+	}
+	status = http.StatusInternalServerError
+	if err := sink.Publish(context.TODO(), event); err == nil {
+		t.Fatalf("expected: an error when the webhook fails")
+	}
+}
+
+func TestNewEventSinks(t *testing.T) {
+	sinks, err := newEventSinks("stdout, webhook:http://localhost:9999/events")
+	if err != nil || len(sinks) != 2 {
+		t.Fatalf("expected: 2 sinks, got: %d (err: %v)", len(sinks), err)
+	}
+	if _, err := newEventSinks("kafka:topic"); err == nil {
+		t.Fatalf("expected: an error for an unknown sink")
+	}
+	if _, err := newEventSinks("webhook"); err == nil {
+		t.Fatalf("expected: an error for a webhook without url")
+	}
+}
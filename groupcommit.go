@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrSaveQueueFull = errors.New("too many saves waiting, retry later")
+
+// pendingSave is a document waiting in the queue of the group commit, done receives its result.
+type pendingSave struct {
+	ctx  context.Context
+	doc  *MyDocument
+	done chan error
+}
+
+// groupCommit queues the saves and inserts them together, when batchSize documents are waiting or window after the
+// first one. Each save still gets its own result.
+type groupCommit struct {
+	documents DocumentStore
+	queue     chan *pendingSave
+	batchSize int
+	window    time.Duration
+}
+
+func newGroupCommit(documents DocumentStore, queueSize int, batchSize int, window time.Duration) *groupCommit {
+	return &groupCommit{documents: documents, queue: make(chan *pendingSave, queueSize), batchSize: batchSize, window: window}
+}
+
+// InsertDocument queues doc and waits for its result. It returns ErrSaveQueueFull at once when the queue is full.
+// A save whose ctx is done while it waits may still be inserted.
+func (g *groupCommit) InsertDocument(ctx context.Context, doc *MyDocument) error {
+	save := &pendingSave{ctx: ctx, doc: doc, done: make(chan error, 1)}
+	select {
+	case g.queue <- save:
+	default:
+		return ErrSaveQueueFull
+	}
+
+	select {
+	case err := <-save.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run inserts the queued saves until ctx is done. The saves queued while a batch is inserted go in the next one.
+func (g *groupCommit) Run(ctx context.Context) {
+	for {
+		var batch []*pendingSave
+		select {
+		case <-ctx.Done():
+			return
+		case save := <-g.queue:
+			batch = append(batch, save)
+		}
+
+		timer := time.NewTimer(g.window)
+	collect:
+		for len(batch) < g.batchSize {
+			select {
+			case save := <-g.queue:
+				batch = append(batch, save)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		g.flush(batch)
+	}
+}
+
+// flush inserts the batch, by tenant as the store of each one is in the context of its saves.
+func (g *groupCommit) flush(batch []*pendingSave) {
+	tenants := map[string][]*pendingSave{}
+	order := []string{}
+	for _, save := range batch {
+		// Nobody waits for it anymore
+		if err := save.ctx.Err(); err != nil {
+			save.done <- err
+			continue
+		}
+		tenant := tenantFrom(save.ctx)
+		if _, ok := tenants[tenant]; !ok {
+			order = append(order, tenant)
+		}
+		tenants[tenant] = append(tenants[tenant], save)
+	}
+
+	for _, tenant := range order {
+		saves := tenants[tenant]
+		// Until the last deadline of the saves, the others stop waiting before
+		var deadline time.Time
+		docs := make([]*MyDocument, 0, len(saves))
+		for _, save := range saves {
+			if d, ok := save.ctx.Deadline(); ok && d.After(deadline) {
+				deadline = d
+			}
+			docs = append(docs, save.doc)
+		}
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if !deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+		}
+		if tenant != "" {
+			ctx = withTenant(ctx, tenant)
+		}
+
+		errs := g.documents.InsertDocuments(ctx, docs)
+		cancel()
+		for i, save := range saves {
+			save.done <- errs[i]
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts the calls to InsertDocuments.
+type countingStore struct {
+	*memoryStore
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *countingStore) InsertDocuments(ctx context.Context, docs []*MyDocument) []error {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	return s.memoryStore.InsertDocuments(ctx, docs)
+}
+
+func TestGroupCommit(t *testing.T) {
+	store := &countingStore{memoryStore: newMemoryStore()}
+	saves := newGroupCommit(store, 100, 10, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go saves.Run(ctx)
+
+	// 10 saves fill a batch, one of them is a duplicate
+	errs := make([]error, 10)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			if i == 9 {
+				key = "key0"
+			}
+			saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			errs[i] = saves.InsertDocument(saveCtx, &MyDocument{Name: "name", Key: key})
+		}()
+	}
+	wg.Wait()
+
+	duplicates := 0
+	for _, err := range errs {
+		if errors.Is(err, ErrDuplicateKey) {
+			duplicates++
+		} else if err != nil {
+			t.Fatalf("expected: saved or duplicate, got: %v", err)
+		}
+	}
+	if duplicates != 1 || store.calls != 1 {
+		t.Fatalf("expected: 1 duplicate in 1 insert, got: %d duplicates in %d inserts", duplicates, store.calls)
+	}
+}
+
+func TestGroupCommitWindow(t *testing.T) {
+	store := newMemoryStore()
+	saves := newGroupCommit(store, 100, 10, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go saves.Run(ctx)
+
+	saveCtx, cancelSave := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelSave()
+	if err := saves.InsertDocument(saveCtx, &MyDocument{Name: "name", Key: "alone"}); err != nil {
+		t.Fatalf("expected: saved after the window, got: %v", err)
+	}
+}
+
+func TestGroupCommitQueueFull(t *testing.T) {
+	store := newMemoryStore()
+	// Nothing reads the queue
+	ctx := &serverContext{documents: store, batches: store, events: newEventBroker(1), saves: newGroupCommit(store, 0, 10, time.Millisecond)}
+	server := httptest.NewServer(ctx.MainServer(true))
+	defer server.Close()
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/save", MyDocument{Name: "name", Key: "key"})
+	expectStatus(t, resp, body, http.StatusServiceUnavailable)
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "1" {
+		t.Fatalf("expected: Retry-After 1, got: %q", retryAfter)
+	}
+}
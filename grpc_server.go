@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mongo-http-audit-service/src/auditpb"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer exposes the same operations as the HTTP endpoints through auditpb.AuditService.
+type grpcServer struct {
+	auditpb.UnimplementedAuditServiceServer
+	ctx *serverContext
+}
+
+func (ctx *serverContext) GrpcServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(actorUnaryInterceptor, ctx.tenantUnaryInterceptor),
+		grpc.StreamInterceptor(ctx.tenantStreamInterceptor),
+	)
+	auditpb.RegisterAuditServiceServer(server, &grpcServer{ctx: ctx})
+	grpc_health_v1.RegisterHealthServer(server, &grpcHealthServer{ctx: ctx, interval: 5 * time.Second})
+	return server
+}
+
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrDuplicateKey):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrInvalidStateChange):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStateConflict):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrVersionMismatch):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ErrCircuitOpen):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrSaveQueueFull), errors.Is(err, ErrSpoolFull), errors.Is(err, ErrTooManyTenants):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrUnknownTenant):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func parseObjectId(value string) (*primitive.ObjectID, error) {
+	if value == "" {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(value)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &id, nil
+}
+
+func toProtoDocument(doc *MyDocument) *auditpb.Document {
+	res := &auditpb.Document{Name: doc.Name, Key: doc.Key, State: doc.State, Version: doc.Version, Reason: doc.Reason, Comment: doc.Comment}
+	if doc.ID != nil {
+		res.Id = doc.ID.Hex()
+	}
+	return res
+}
+
+func (g *grpcServer) Save(ctx context.Context, req *auditpb.SaveRequest) (*auditpb.Document, error) {
+	id, err := parseObjectId(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	doc := MyDocument{ID: id, Name: req.GetName(), Key: req.GetKey()}
+	// A spooled document is answered like a saved one
+	if _, err := g.ctx.saveDocument(ctx, &doc); err != nil {
+		return nil, grpcError(err)
+	}
+	return toProtoDocument(&doc), nil
+}
+
+func (g *grpcServer) GetDocument(ctx context.Context, req *auditpb.GetDocumentRequest) (*auditpb.Document, error) {
+	doc, err := g.ctx.findDocument(ctx, req.GetKey())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProtoDocument(doc), nil
+}
+
+// UpdateState goes through the state machine like PUT /documents/{key}/state, version is the If-Match.
+func (g *grpcServer) UpdateState(ctx context.Context, req *auditpb.UpdateStateRequest) (*auditpb.UpdateStateResponse, error) {
+	change := StateChangeRequest{State: req.GetState(), Reason: req.GetReason(), Comment: req.GetComment(), ExpectedCurrentState: req.GetExpectedCurrentState()}
+	doc, err := g.ctx.changeState(ctx, req.GetKey(), change, req.GetVersion())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &auditpb.UpdateStateResponse{MatchedCount: 1, ModifiedCount: 1, State: doc.State, Document: toProtoDocument(doc)}, nil
+}
+
+func (g *grpcServer) SaveBatch(ctx context.Context, req *auditpb.SaveBatchRequest) (*auditpb.SaveBatchResponse, error) {
+	id, err := parseObjectId(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	batch := MyDocumentList{ID: id, ToProcess: make([]MyDocument, 0, len(req.GetDocuments()))}
+	for _, doc := range req.GetDocuments() {
+		batch.ToProcess = append(batch.ToProcess, MyDocument{Name: doc.GetName(), Key: doc.GetKey()})
+	}
+	if err := g.ctx.saveBatch(ctx, &batch); err != nil {
+		return nil, grpcError(err)
+	}
+	return &auditpb.SaveBatchResponse{Id: batch.ID.Hex()}, nil
+}
+
+func (g *grpcServer) ProcessBatch(ctx context.Context, req *auditpb.ProcessBatchRequest) (*auditpb.ProcessBatchResponse, error) {
+	id, err := parseObjectId(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, status.Error(codes.InvalidArgument, "id can't be empty")
+	}
+	res, processedKeys, err := g.ctx.processBatch(ctx, *id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &auditpb.ProcessBatchResponse{MatchedCount: res.MatchedCount, ModifiedCount: res.ModifiedCount, ProcessedKeys: processedKeys}, nil
+}
+
+func (g *grpcServer) WatchStates(req *auditpb.WatchStatesRequest, stream grpc.ServerStreamingServer[auditpb.StateChangeEvent]) error {
+	if g.ctx.events == nil {
+		return status.Error(codes.Unavailable, "events are disabled")
+	}
+	filter := eventFilter{states: req.GetStates(), keyPrefix: req.GetKeyPrefix(), tenant: tenantFrom(stream.Context())}
+
+	missed, subscriber := g.ctx.events.Subscribe(req.GetLastEventId())
+	defer g.ctx.events.Unsubscribe(subscriber)
+
+	send := func(sequenced sequencedEvent) error {
+		if !filter.match(sequenced.event) {
+			return nil
+		}
+		event := sequenced.event
+		return stream.Send(&auditpb.StateChangeEvent{
+			EventId:    sequenced.seq,
+			Id:         event.ID,
+			Type:       event.Type,
+			Key:        event.Key,
+			DocumentId: event.DocumentID,
+			State:      event.State,
+			Time:       timestamppb.New(event.Time),
+		})
+	}
+
+	for _, sequenced := range missed {
+		if err := send(sequenced); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case sequenced, ok := <-subscriber:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "client is too slow, resume with the last event id")
+			}
+			if err := send(sequenced); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcHealthServer answers the standard health checks with the same store ping as /health.
+type grpcHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	ctx      *serverContext
+	interval time.Duration
+}
+
+func (h *grpcHealthServer) status(ctx context.Context) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	ctx, cancel := context.WithTimeout(ctx, h.ctx.runtime().readTimeout)
+	defer cancel()
+	if err := h.ctx.documents.Ping(ctx); err != nil {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+func (h *grpcHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: h.status(ctx)}, nil
+}
+
+// Watch sends the status and then every change of it.
+func (h *grpcHealthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc.ServerStreamingServer[grpc_health_v1.HealthCheckResponse]) error {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	last := grpc_health_v1.HealthCheckResponse_UNKNOWN
+	for {
+		if current := h.status(stream.Context()); current != last {
+			if err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+			last = current
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
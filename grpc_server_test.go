@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"mongo-http-audit-service/src/auditpb"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestGrpcClient(t *testing.T) *grpc.ClientConn {
+	ctx := &serverContext{documents: newMemoryStore(), events: newEventBroker(100)}
+	ctx.batches = ctx.documents.(BatchStore)
+	return newTestGrpcClientFor(t, ctx)
+}
+
+func newTestGrpcClientFor(t *testing.T, ctx *serverContext) *grpc.ClientConn {
+	listener := bufconn.Listen(1024 * 1024)
+	server := ctx.GrpcServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Could not create grpc client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func expectCode(t *testing.T, err error, expected codes.Code) {
+	t.Helper()
+	if status.Code(err) != expected {
+		t.Fatalf("expected: code %s, got: %v", expected, err)
+	}
+}
+
+func TestGrpcServer(t *testing.T) {
+	conn := newTestGrpcClient(t)
+	client := auditpb.NewAuditServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+
+	watch, err := client.WatchStates(ctx, &auditpb.WatchStatesRequest{States: []string{STATE_PROCESSED}})
+	if err != nil {
+		t.Fatalf("Could not watch states: %v", err)
+	}
+
+	doc, err := client.Save(ctx, &auditpb.SaveRequest{Name: "name1", Key: "key1"})
+	if err != nil || doc.GetId() == "" || doc.GetState() != STATE_INIT {
+		t.Fatalf("expected: a saved document in state %s, got: %v (err: %v)", STATE_INIT, doc, err)
+	}
+	_, err = client.Save(ctx, &auditpb.SaveRequest{Name: "name1", Key: "key1"})
+	expectCode(t, err, codes.AlreadyExists)
+	_, err = client.Save(ctx, &auditpb.SaveRequest{Id: "notAnId", Key: "key2"})
+	expectCode(t, err, codes.InvalidArgument)
+	client.Save(ctx, &auditpb.SaveRequest{Name: "name2", Key: "key2"})
+
+	// Same checks as PUT /documents/{key}/state
+	_, err = client.UpdateState(ctx, &auditpb.UpdateStateRequest{Key: "key1", State: STATE_VERIFIED, Version: doc.GetVersion() + 1})
+	expectCode(t, err, codes.Aborted)
+	_, err = client.UpdateState(ctx, &auditpb.UpdateStateRequest{Key: "key1", State: STATE_VERIFIED, ExpectedCurrentState: STATE_REJECTED})
+	expectCode(t, err, codes.FailedPrecondition)
+	_, err = client.UpdateState(ctx, &auditpb.UpdateStateRequest{Key: "key1"})
+	expectCode(t, err, codes.InvalidArgument)
+	updated, err := client.UpdateState(ctx, &auditpb.UpdateStateRequest{Key: "key1", State: "verified", Comment: "checked", Version: doc.GetVersion()})
+	if err != nil || updated.GetModifiedCount() != 1 || updated.GetState() != STATE_VERIFIED || updated.GetDocument().GetComment() != "checked" || updated.GetDocument().GetVersion() != doc.GetVersion()+1 {
+		t.Fatalf("expected: key1 to be verified, got: %v (err: %v)", updated, err)
+	}
+	_, err = client.UpdateState(ctx, &auditpb.UpdateStateRequest{Key: "key1", State: STATE_INIT})
+	expectCode(t, err, codes.FailedPrecondition)
+
+	found, err := client.GetDocument(ctx, &auditpb.GetDocumentRequest{Key: "key1"})
+	if err != nil || found.GetState() != STATE_VERIFIED || found.GetId() != doc.GetId() {
+		t.Fatalf("expected: key1 in state %s, got: %v (err: %v)", STATE_VERIFIED, found, err)
+	}
+	_, err = client.GetDocument(ctx, &auditpb.GetDocumentRequest{Key: "unknown"})
+	expectCode(t, err, codes.NotFound)
+
+	batch, err := client.SaveBatch(ctx, &auditpb.SaveBatchRequest{Documents: []*auditpb.Document{{Key: "key1"}, {Key: "key2"}}})
+	if err != nil {
+		t.Fatalf("Could not save batch: %v", err)
+	}
+	processed, err := client.ProcessBatch(ctx, &auditpb.ProcessBatchRequest{Id: batch.GetId()})
+	if err != nil || processed.GetModifiedCount() != 2 || len(processed.GetProcessedKeys()) != 2 {
+		t.Fatalf("expected: 2 processed documents, got: %v (err: %v)", processed, err)
+	}
+	_, err = client.ProcessBatch(ctx, &auditpb.ProcessBatchRequest{Id: "68456150d9f3c97acb426ed8"})
+	expectCode(t, err, codes.NotFound)
+
+	for _, key := range []string{"key1", "key2"} {
+		event, err := watch.Recv()
+		if err != nil || event.GetKey() != key || event.GetState() != STATE_PROCESSED || event.GetEventId() == 0 {
+			t.Fatalf("expected: processed event of %s, got: %v (err: %v)", key, event, err)
+		}
+	}
+
+	health, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil || health.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("expected: SERVING, got: %v (err: %v)", health, err)
+	}
+}
+
+func TestGrpcHealthWithoutTenant(t *testing.T) {
+	ctx := &serverContext{documents: newMemoryStore(), events: newEventBroker(100), tenancy: &tenancy{claim: "tenant_id"}}
+	ctx.batches = ctx.documents.(BatchStore)
+	conn := newTestGrpcClientFor(t, ctx)
+	callCtx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+
+	health, err := grpc_health_v1.NewHealthClient(conn).Check(callCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil || health.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("expected: SERVING without tenant, got: %v (err: %v)", health, err)
+	}
+	watch, err := grpc_health_v1.NewHealthClient(conn).Watch(callCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Could not watch health: %v", err)
+	}
+	if health, err := watch.Recv(); err != nil || health.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("expected: SERVING without tenant, got: %v (err: %v)", health, err)
+	}
+
+	// The data still needs a tenant
+	_, err = auditpb.NewAuditServiceClient(conn).GetDocument(callCtx, &auditpb.GetDocumentRequest{Key: "key1"})
+	expectCode(t, err, codes.InvalidArgument)
+}
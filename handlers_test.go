@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeFactory returns a new empty store for each test of the handler suite.
+type storeFactory func(t *testing.T) Store
+
+const testAdminToken = "adminToken"
+
+// adminHeader is the header of the requests to the /admin/ routes.
+var adminHeader = http.Header{HEADER_ADMIN_TOKEN: {testAdminToken}}
+
+func newTestServer(t *testing.T, factory storeFactory) string {
+	return newTestServerWithStates(t, factory, defaultStateMachine)
+}
+
+// newTestServerWithStates starts a test server with these state transitions.
+func newTestServerWithStates(t *testing.T, factory storeFactory, states stateMachine) string {
+	store := factory(t)
+	webhooks := newWebhookDispatcher(store, 3, 10*time.Millisecond, time.Second, 5*time.Second)
+	// The receivers of the tests listen on localhost
+	webhooks.allowLoopback = true
+	webhooksCtx, cancel := context.WithCancel(context.Background())
+	webhooks.Start(webhooksCtx, 2)
+	t.Cleanup(cancel)
+
+	ctx := &serverContext{documents: store, batches: store, webhooks: webhooks, events: newEventBroker(100), adminToken: testAdminToken}
+	settings := defaultRuntimeSettings
+	settings.maxPayloadSize = 1024
+	settings.states = states
+	ctx.settings.Store(&settings)
+	server := httptest.NewServer(ctx.MainServer(true))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func doRequest(t *testing.T, method string, url string, body any) (*http.Response, []byte) {
+	t.Helper()
+	return doRequestWithHeader(t, method, url, body, nil)
+}
+
+func doRequestWithHeader(t *testing.T, method string, url string, body any, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Error marshaling JSON: %v", err)
+		}
+		reader = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("Creating request (%s %s) failed: %v", method, url, err)
+	}
+	req.Header.Set("Content-Type", contentTypeJson)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s request (url: %s) failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	return resp, respBody
+}
+
+func expectStatus(t *testing.T, resp *http.Response, body []byte, expected int) {
+	t.Helper()
+	if resp.StatusCode != expected {
+		t.Fatalf("expected: status %d, got: %d (body: %s)", expected, resp.StatusCode, body)
+	}
+}
+
+func testHandlers(t *testing.T, factory storeFactory) {
+	t.Run("Save", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"})
+		expectStatus(t, resp, body, http.StatusOK)
+
+		var doc MyDocument
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Fatalf("Could not deserialized body: %s", body)
+		}
+		if doc.ID == nil || doc.Key != "key1" || doc.Name != "test1" || doc.State != STATE_INIT {
+			t.Fatalf("expected: {key: key1 | name: test1 | state: %s}, got: %v", STATE_INIT, doc)
+		}
+
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		var found MyDocument
+		if err := json.Unmarshal(body, &found); err != nil || *found.ID != *doc.ID || found.State != STATE_INIT {
+			t.Fatalf("expected: %v, got: %s", doc, body)
+		}
+
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/unknown", nil)
+		expectStatus(t, resp, body, http.StatusNotFound)
+	})
+
+	t.Run("SaveDuplicateKey", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		doc := MyDocument{Name: "test1", Key: "key1"}
+		resp, body := doRequest(t, http.MethodPost, url+"/save", doc)
+		expectStatus(t, resp, body, http.StatusOK)
+
+		resp, body = doRequest(t, http.MethodPost, url+"/save", doc)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+
+		expected := "keyIndex dup key: { key: \"" + doc.Key + "\" }"
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("expected: (%s) in (%s) but it was not in the body", expected, body)
+		}
+	})
+
+	t.Run("SaveInvalidBody", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodPost, url+"/save", nil)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	})
+
+	t.Run("UpdateOnlyFromInit", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"})
+		expectStatus(t, resp, body, http.StatusOK)
+
+		resp, body = doRequest(t, http.MethodPut, url+"/update/key1/verified", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if expected := "Match: 1| Updated: 1 | Update to state: VERIFIED"; string(body) != expected {
+			t.Fatalf("expected: %s, got: %s", expected, body)
+		}
+
+		resp, body = doRequest(t, http.MethodPut, url+"/update/key1/rejected", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if expected := "Match: 0| Updated: 0 | Update to state: REJECTED"; string(body) != expected {
+			t.Fatalf("expected: %s, got: %s", expected, body)
+		}
+
+		resp, body = doRequest(t, http.MethodPut, url+"/update/unknown/rejected", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if expected := "Match: 0| Updated: 0 | Update to state: REJECTED"; string(body) != expected {
+			t.Fatalf("expected: %s, got: %s", expected, body)
+		}
+	})
+
+	t.Run("ChangeState", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"})
+		expectStatus(t, resp, body, http.StatusOK)
+
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: "rejected", Reason: "missing signature", Comment: "checked by hand", ExpectedCurrentState: STATE_INIT})
+		expectStatus(t, resp, body, http.StatusOK)
+		var doc MyDocument
+		if err := json.Unmarshal(body, &doc); err != nil || doc.State != STATE_REJECTED || doc.Reason != "missing signature" || doc.Comment != "checked by hand" {
+			t.Fatalf("expected: key1 rejected with its reason and comment, got: %s", body)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if err := json.Unmarshal(body, &doc); err != nil || doc.State != STATE_REJECTED || doc.Reason != "missing signature" {
+			t.Fatalf("expected: the reason to be saved, got: %s", body)
+		}
+
+		// REJECTED can't go back to VERIFIED
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_VERIFIED})
+		expectStatus(t, resp, body, http.StatusConflict)
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_PROCESSED, ExpectedCurrentState: STATE_INIT})
+		expectStatus(t, resp, body, http.StatusConflict)
+
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_PROCESSED, Comment: "done"})
+		expectStatus(t, resp, body, http.StatusOK)
+		var processed MyDocument
+		if err := json.Unmarshal(body, &processed); err != nil || processed.State != STATE_PROCESSED || processed.Reason != "" || processed.Comment != "done" {
+			t.Fatalf("expected: key1 processed without reason, got: %s", body)
+		}
+
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: "UNKNOWN"})
+		expectStatus(t, resp, body, http.StatusBadRequest)
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", nil)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/unknown/state", StateChangeRequest{State: STATE_VERIFIED})
+		expectStatus(t, resp, body, http.StatusNotFound)
+
+		// A reason is only for rejections
+		resp, body = doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test2", Key: "key2"})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodPut, url+"/documents/key2/state", StateChangeRequest{State: STATE_VERIFIED, Reason: "why not"})
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"})
+		expectStatus(t, resp, body, http.StatusOK)
+		if etag := resp.Header.Get("ETag"); etag != `"1"` {
+			t.Fatalf("expected: ETag \"1\", got: %s", etag)
+		}
+
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		etag := resp.Header.Get("ETag")
+
+		// Two reviewers read the same version, the second one to write fails
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/update/key1/verified", nil, http.Header{"If-Match": {etag}})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/update/key1/rejected", nil, http.Header{"If-Match": {etag}})
+		expectStatus(t, resp, body, http.StatusPreconditionFailed)
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_PROCESSED}, http.Header{"If-Match": {etag}})
+		expectStatus(t, resp, body, http.StatusPreconditionFailed)
+
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		var doc MyDocument
+		if err := json.Unmarshal(body, &doc); err != nil || doc.Version != 2 || doc.State != STATE_VERIFIED || resp.Header.Get("ETag") != `"2"` {
+			t.Fatalf("expected: key1 verified in version 2, got: %s (ETag: %s)", body, resp.Header.Get("ETag"))
+		}
+
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_PROCESSED}, http.Header{"If-Match": {`"2"`}})
+		expectStatus(t, resp, body, http.StatusOK)
+		if etag := resp.Header.Get("ETag"); etag != `"3"` {
+			t.Fatalf("expected: ETag \"3\", got: %s", etag)
+		}
+
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_PROCESSED}, http.Header{"If-Match": {"3"}})
+		expectStatus(t, resp, body, http.StatusBadRequest)
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/update/unknown/verified", nil, http.Header{"If-Match": {`"1"`}})
+		expectStatus(t, resp, body, http.StatusPreconditionFailed)
+	})
+
+	t.Run("SameStateChange", func(t *testing.T) {
+		url := newTestServerWithStates(t, factory, stateMachine{STATE_INIT: {STATE_VERIFIED}, STATE_VERIFIED: {STATE_VERIFIED}})
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"})
+		expectStatus(t, resp, body, http.StatusOK)
+
+		// Every store writes a new version, even when nothing changes
+		for version := 2; version <= 3; version++ {
+			resp, body = doRequest(t, http.MethodPut, url+"/documents/key1/state", StateChangeRequest{State: STATE_VERIFIED, Comment: "checked"})
+			expectStatus(t, resp, body, http.StatusOK)
+			if etag := resp.Header.Get("ETag"); etag != fmt.Sprintf(`"%d"`, version) {
+				t.Fatalf("expected: ETag \"%d\", got: %s", version, etag)
+			}
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		var doc MyDocument
+		if err := json.Unmarshal(body, &doc); err != nil || doc.Version != 3 || doc.State != STATE_VERIFIED {
+			t.Fatalf("expected: key1 verified in version 3, got: %s", body)
+		}
+	})
+
+	t.Run("LegacyRoutesFollowStateMachine", func(t *testing.T) {
+		url := newTestServerWithStates(t, factory, stateMachine{STATE_INIT: {STATE_VERIFIED, STATE_PROCESSED}, STATE_VERIFIED: {STATE_REJECTED}})
+		for i := range 2 {
+			resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: fmt.Sprintf("test%d", i), Key: fmt.Sprintf("key%d", i)})
+			expectStatus(t, resp, body, http.StatusOK)
+		}
+
+		resp, body := doRequest(t, http.MethodPut, url+"/update/key0/rejected", nil)
+		expectStatus(t, resp, body, http.StatusConflict)
+		resp, body = doRequest(t, http.MethodPut, url+"/update/key0/verified", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+
+		// VERIFIED can't move to PROCESSED anymore
+		resp, body = doRequest(t, http.MethodPost, url+"/batch/save", MyDocumentList{ToProcess: []MyDocument{{Key: "key0"}, {Key: "key1"}}})
+		expectStatus(t, resp, body, http.StatusOK)
+		var batchId MyDocumentId
+		if err := json.Unmarshal(body, &batchId); err != nil || batchId.ID == nil {
+			t.Fatalf("Could not deserialized batch id: %s", body)
+		}
+		resp, body = doRequest(t, http.MethodPut, url+"/process/"+batchId.ID.Hex(), nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		var res UpdateResult
+		if err := json.Unmarshal(body, &res); err != nil || res.ModifiedCount != 1 {
+			t.Fatalf("expected: only key1 processed, got: %s", body)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key0", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		var doc MyDocument
+		if err := json.Unmarshal(body, &doc); err != nil || doc.State != STATE_VERIFIED {
+			t.Fatalf("expected: key0 still verified, got: %s", body)
+		}
+	})
+
+	t.Run("Timestamps", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		before := time.Now().Add(-time.Second)
+		resp, body := doRequestWithHeader(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"}, http.Header{HEADER_USER: {"alice"}})
+		expectStatus(t, resp, body, http.StatusOK)
+		var saved MyDocument
+		if err := json.Unmarshal(body, &saved); err != nil || saved.CreatedAt == nil || saved.CreatedAt.Before(before) || saved.CreatedBy != "alice" || saved.UpdatedBy != "alice" {
+			t.Fatalf("expected: key1 created now by alice, got: %s", body)
+		}
+
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/update/key1/verified", nil, http.Header{HEADER_USER: {"bob"}})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		var verified MyDocument
+		if err := json.Unmarshal(body, &verified); err != nil || verified.CreatedBy != "alice" || verified.UpdatedBy != "bob" ||
+			!verified.CreatedAt.Equal(*saved.CreatedAt) || verified.StateChangedAt == nil || verified.StateChangedAt.Before(*saved.CreatedAt) {
+			t.Fatalf("expected: key1 created by alice and verified by bob, got: %s", body)
+		}
+
+		resp, body = doRequest(t, http.MethodPost, url+"/batch/save", MyDocumentList{ToProcess: []MyDocument{{Key: "key1"}}})
+		expectStatus(t, resp, body, http.StatusOK)
+		var batchId MyDocumentId
+		json.Unmarshal(body, &batchId)
+		resp, body = doRequestWithHeader(t, http.MethodPut, url+"/process/"+batchId.ID.Hex(), nil, http.Header{HEADER_USER: {"carol"}})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		var processed MyDocument
+		if err := json.Unmarshal(body, &processed); err != nil || processed.State != STATE_PROCESSED || processed.UpdatedBy != "carol" || processed.UpdatedAt.Before(*verified.UpdatedAt) {
+			t.Fatalf("expected: key1 processed by carol, got: %s", body)
+		}
+	})
+
+	t.Run("PayloadAndLabels", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		doc := MyDocument{
+			Name:    "invoice1",
+			Key:     "key1",
+			Payload: map[string]any{"amount": 12.5, "customer": map[string]any{"name": "ACME", "country": "FR"}},
+			Labels:  map[string]string{"team": "billing"},
+		}
+		resp, body := doRequest(t, http.MethodPost, url+"/save", doc)
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "invoice2", Key: "key2", Labels: map[string]string{"team": "sales"}})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodPost, url+"/save", MyDocument{Key: "key3", Payload: map[string]any{"blob": strings.Repeat("a", 2048)}})
+		expectStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+		// A body much larger than maxPayloadSize isn't even read
+		for method, path := range map[string]string{http.MethodPost: "/save", http.MethodPatch: "/documents/key1"} {
+			resp, body = doRequest(t, method, url+path, MyDocument{Key: "key3", Payload: map[string]any{"blob": strings.Repeat("a", 64*1024)}})
+			expectStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+			if !strings.Contains(string(body), "request body too large") {
+				t.Fatalf("expected: the body to be cut, got: %s", body)
+			}
+		}
+		resp, body = doRequest(t, http.MethodPost, url+"/save", MyDocument{Key: "key3", Labels: map[string]string{"a.b": "c"}})
+		expectStatus(t, resp, body, http.StatusBadRequest)
+
+		resp, body = doRequest(t, http.MethodGet, url+"/documents?label=team:billing", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		var docs []MyDocument
+		if err := json.Unmarshal(body, &docs); err != nil || len(docs) != 1 || docs[0].Key != "key1" || docs[0].Payload["customer"] == nil {
+			t.Fatalf("expected: only key1 with its payload, got: %s", body)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents?limit=1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if err := json.Unmarshal(body, &docs); err != nil || len(docs) != 1 || resp.Header.Get(HEADER_NEXT_AFTER_KEY) != "key1" {
+			t.Fatalf("expected: key1 and the key of the next page, got: %s (%s: %s)", body, HEADER_NEXT_AFTER_KEY, resp.Header.Get(HEADER_NEXT_AFTER_KEY))
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents?limit=1&afterKey=key1", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if err := json.Unmarshal(body, &docs); err != nil || len(docs) != 1 || docs[0].Key != "key2" {
+			t.Fatalf("expected: key2, got: %s", body)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents?limit=1000000", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if err := json.Unmarshal(body, &docs); err != nil || len(docs) != 2 || resp.Header.Get(HEADER_NEXT_AFTER_KEY) != "" {
+			t.Fatalf("expected: the last page with key1 and key2, got: %s", body)
+		}
+
+		mergePatch := http.Header{"Content-Type": {contentTypeMergePatch}, "If-Match": {`"1"`}}
+		patch := map[string]any{"payload": map[string]any{"amount": 15, "customer": map[string]any{"country": nil}}, "labels": map[string]any{"team": nil, "priority": "high"}}
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/key1", patch, mergePatch)
+		expectStatus(t, resp, body, http.StatusOK)
+		var patched MyDocument
+		if err := json.Unmarshal(body, &patched); err != nil {
+			t.Fatalf("Could not deserialized body: %s", body)
+		}
+		customer, _ := patched.Payload["customer"].(map[string]any)
+		if patched.Name != "invoice1" || patched.Payload["amount"] != 15.0 || customer["name"] != "ACME" || customer["country"] != nil ||
+			len(patched.Labels) != 1 || patched.Labels["priority"] != "high" || patched.Version != 2 {
+			t.Fatalf("expected: the merge patch to be applied, got: %s", body)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		var found MyDocument
+		if err := json.Unmarshal(body, &found); err != nil || found.Payload["amount"] != 15.0 || found.Labels["priority"] != "high" {
+			t.Fatalf("expected: the patch to be saved, got: %s", body)
+		}
+
+		// The ETag "1" is outdated
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/key1", map[string]any{"name": "other"}, mergePatch)
+		expectStatus(t, resp, body, http.StatusPreconditionFailed)
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/key1", map[string]any{"state": STATE_PROCESSED}, http.Header{"Content-Type": {contentTypeMergePatch}})
+		expectStatus(t, resp, body, http.StatusBadRequest)
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/key1", map[string]any{"labels": map[string]any{"count": 3}}, http.Header{"Content-Type": {contentTypeMergePatch}})
+		expectStatus(t, resp, body, http.StatusBadRequest)
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/key1", map[string]any{"name": "other"}, http.Header{"Content-Type": {"text/plain"}})
+		expectStatus(t, resp, body, http.StatusUnsupportedMediaType)
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/unknown", map[string]any{"name": "other"}, http.Header{"Content-Type": {contentTypeMergePatch}})
+		expectStatus(t, resp, body, http.StatusNotFound)
+
+		// Removing the payload
+		resp, body = doRequestWithHeader(t, http.MethodPatch, url+"/documents/key1", map[string]any{"payload": nil}, http.Header{"Content-Type": {contentTypeMergePatch}})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		if strings.Contains(string(body), "payload") {
+			t.Fatalf("expected: no payload anymore, got: %s", body)
+		}
+	})
+
+	t.Run("BulkTransition", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		for i := range 5 {
+			resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: fmt.Sprintf("invoice%d", i), Key: fmt.Sprintf("key%d", i)})
+			expectStatus(t, resp, body, http.StatusOK)
+		}
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "receipt", Key: "key5"})
+		expectStatus(t, resp, body, http.StatusOK)
+		resp, body = doRequest(t, http.MethodPut, url+"/update/key0/verified", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+
+		transition := func(req BulkTransitionRequest) BulkTransitionResult {
+			t.Helper()
+			resp, body := doRequest(t, http.MethodPost, url+"/documents/transition", req)
+			expectStatus(t, resp, body, http.StatusOK)
+			var res BulkTransitionResult
+			if err := json.Unmarshal(body, &res); err != nil {
+				t.Fatalf("Could not deserialized bulk transition result: %s", body)
+			}
+			return res
+		}
+
+		// key0 is VERIFIED and can't be rejected anymore
+		filter := &DocumentFilter{NamePrefix: "invoice"}
+		res := transition(BulkTransitionRequest{Filter: filter, State: STATE_REJECTED, Reason: "duplicate", DryRun: true})
+		if expected := (BulkTransitionResult{DryRun: true, Selected: 5, Affected: 4, Skipped: 1}); res != expected {
+			t.Fatalf("expected: %+v, got: %+v", expected, res)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key1", nil)
+		if !strings.Contains(string(body), STATE_INIT) {
+			t.Fatalf("expected: key1 to stay in %s after a dry run, got: %s", STATE_INIT, body)
+		}
+
+		res = transition(BulkTransitionRequest{Filter: filter, State: STATE_REJECTED, Reason: "duplicate"})
+		if expected := (BulkTransitionResult{Selected: 5, Affected: 4, Skipped: 1}); res != expected {
+			t.Fatalf("expected: %+v, got: %+v", expected, res)
+		}
+		resp, body = doRequest(t, http.MethodGet, url+"/documents/key4", nil)
+		var doc MyDocument
+		if err := json.Unmarshal(body, &doc); err != nil || doc.State != STATE_REJECTED || doc.Reason != "duplicate" || doc.Version != 2 {
+			t.Fatalf("expected: key4 rejected in version 2, got: %s", body)
+		}
+
+		res = transition(BulkTransitionRequest{Keys: []string{"key0", "key5", "unknown"}, State: STATE_PROCESSED})
+		if expected := (BulkTransitionResult{Selected: 2, Affected: 2}); res != expected {
+			t.Fatalf("expected: %+v, got: %+v", expected, res)
+		}
+
+		future := time.Now().Add(time.Hour)
+		res = transition(BulkTransitionRequest{Filter: &DocumentFilter{State: "rejected", CreatedBefore: &future}, State: STATE_PROCESSED, DryRun: true})
+		if expected := (BulkTransitionResult{DryRun: true, Selected: 4, Affected: 4}); res != expected {
+			t.Fatalf("expected: %+v, got: %+v", expected, res)
+		}
+
+		// Every document only with all
+		res = transition(BulkTransitionRequest{Filter: &DocumentFilter{}, All: true, State: STATE_PROCESSED, DryRun: true})
+		if expected := (BulkTransitionResult{DryRun: true, Selected: 6, Affected: 4, Skipped: 2}); res != expected {
+			t.Fatalf("expected: %+v, got: %+v", expected, res)
+		}
+
+		for _, req := range []BulkTransitionRequest{
+			{State: STATE_PROCESSED},
+			{Filter: &DocumentFilter{}, State: STATE_PROCESSED},
+			{Keys: []string{"key1"}, Filter: filter, State: STATE_PROCESSED},
+			{Keys: []string{"key1"}, State: "UNKNOWN"},
+			{Keys: []string{"key1"}, State: STATE_VERIFIED, Reason: "only for rejections"},
+		} {
+			resp, body = doRequest(t, http.MethodPost, url+"/documents/transition", req)
+			expectStatus(t, resp, body, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("ProcessBatch", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		for i := range 3 {
+			resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: fmt.Sprintf("test%d", i), Key: fmt.Sprintf("key%d", i)})
+			expectStatus(t, resp, body, http.StatusOK)
+		}
+
+		batch := MyDocumentList{ToProcess: []MyDocument{{Key: "key0"}, {Key: "key1"}, {Key: "unknown"}}}
+		resp, body := doRequest(t, http.MethodPost, url+"/batch/save", batch)
+		expectStatus(t, resp, body, http.StatusOK)
+
+		var batchId MyDocumentId
+		if err := json.Unmarshal(body, &batchId); err != nil || batchId.ID == nil {
+			t.Fatalf("Could not deserialized batch id: %s", body)
+		}
+
+		resp, body = doRequest(t, http.MethodPut, url+"/process/"+batchId.ID.Hex(), nil)
+		expectStatus(t, resp, body, http.StatusOK)
+
+		var res UpdateResult
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatalf("Could not deserialized bulk result: %s", body)
+		}
+		if res.MatchedCount != 2 || res.ModifiedCount != 2 {
+			t.Fatalf("expected: 2 matched and 2 modified, got: %+v", res)
+		}
+
+		// Processing twice the same batch doesn't update anything
+		resp, body = doRequest(t, http.MethodPut, url+"/process/"+batchId.ID.Hex(), nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatalf("Could not deserialized bulk result: %s", body)
+		}
+		if res.MatchedCount != 0 || res.ModifiedCount != 0 {
+			t.Fatalf("expected: 0 matched and 0 modified, got: %+v", res)
+		}
+
+		// A processed document can't be verified anymore
+		resp, body = doRequest(t, http.MethodPut, url+"/update/key0/verified", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if expected := "Match: 0| Updated: 0 | Update to state: VERIFIED"; string(body) != expected {
+			t.Fatalf("expected: %s, got: %s", expected, body)
+		}
+	})
+
+	t.Run("ProcessBatchErrors", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodPut, url+"/process/notAnObjectId", nil)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+
+		resp, body = doRequest(t, http.MethodPut, url+"/process/68456150d9f3c97acb426ed8", nil)
+		expectStatus(t, resp, body, http.StatusNotFound)
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		url := newTestServer(t, factory)
+		resp, body := doRequest(t, http.MethodGet, url+"/health", nil)
+		expectStatus(t, resp, body, http.StatusOK)
+		if string(body) != "UP" {
+			t.Fatalf("expected: UP, got: %s", body)
+		}
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		testWebhooks(t, factory)
+	})
+
+	t.Run("InsertDocuments", func(t *testing.T) {
+		store := factory(t)
+		if err := store.InsertDocument(context.Background(), &MyDocument{Name: "name", Key: "existing", State: STATE_INIT}); err != nil {
+			t.Fatalf("Could not insert document: %v", err)
+		}
+
+		docs := []*MyDocument{{Key: "a", State: STATE_INIT}, {Key: "existing", State: STATE_INIT}, {Key: "b", State: STATE_INIT}, {Key: "a", State: STATE_INIT}}
+		errs := store.InsertDocuments(context.Background(), docs)
+		for i, expected := range []bool{false, true, false, true} {
+			if duplicate := errors.Is(errs[i], ErrDuplicateKey); duplicate != expected {
+				t.Fatalf("expected: duplicate %v for %s, got: %v", expected, docs[i].Key, errs[i])
+			}
+		}
+		found, err := store.FindDocuments(context.Background(), DocumentQuery{})
+		if err != nil || len(found) != 3 {
+			t.Fatalf("expected: 3 documents, got: %d (err: %v)", len(found), err)
+		}
+	})
+}
+
+func memoryStoreFactory(t *testing.T) Store {
+	return newMemoryStore()
+}
+
+func TestHandlersMemoryStore(t *testing.T) {
+	testHandlers(t, memoryStoreFactory)
+}
+
+func TestHandlersMongoStore(t *testing.T) {
+	requireMongo(t)
+	restartMongoIfStopped()
+
+	nbDatabase := 0
+	testHandlers(t, func(t *testing.T) Store {
+		nbDatabase++
+		dbName := fmt.Sprintf("handlerSuite%d", nbDatabase)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+			defer cancel()
+			mongoClient.Database(dbName).Drop(ctx)
+		})
+		return newMongoStore(mongoClient, dbName)
+	})
+}
+
+// pagingStore counts the pages read by FindDocuments.
+type pagingStore struct {
+	*memoryStore
+	pages int
+}
+
+func (s *pagingStore) FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error) {
+	s.pages++
+	return s.memoryStore.FindDocuments(ctx, query)
+}
+
+func TestBulkTransitionPages(t *testing.T) {
+	store := &pagingStore{memoryStore: newMemoryStore()}
+	docs := make([]*MyDocument, 0, 2*bulkTransitionChunkSize+1)
+	for i := range cap(docs) {
+		docs = append(docs, &MyDocument{Name: "name", Key: fmt.Sprintf("key%04d", i), State: STATE_INIT})
+	}
+	for _, err := range store.InsertDocuments(context.Background(), docs) {
+		if err != nil {
+			t.Fatalf("Could not insert documents: %v", err)
+		}
+	}
+	ctx := &serverContext{documents: store, batches: store, events: newEventBroker(1)}
+	ctx.settings.Store(&defaultRuntimeSettings)
+
+	res, err := ctx.bulkTransition(context.Background(), BulkTransitionRequest{Filter: &DocumentFilter{State: STATE_INIT}, State: STATE_VERIFIED})
+	if err != nil || res.Selected != int64(len(docs)) || res.Affected != int64(len(docs)) || store.pages != 3 {
+		t.Fatalf("expected: %d documents moved in 3 pages, got: %+v in %d pages (err: %v)", len(docs), res, store.pages, err)
+	}
+}
+
+func TestListDocumentsMaxLimit(t *testing.T) {
+	store := newMemoryStore()
+	for _, key := range []string{"key1", "key2"} {
+		if err := store.InsertDocument(context.Background(), &MyDocument{Name: "name", Key: key, State: STATE_INIT}); err != nil {
+			t.Fatalf("Could not insert document: %v", err)
+		}
+	}
+	ctx := &serverContext{documents: store, batches: store, events: newEventBroker(1)}
+	settings := defaultRuntimeSettings
+	settings.maxListingLimit = 1
+	ctx.settings.Store(&settings)
+	server := httptest.NewServer(ctx.MainServer(true))
+	defer server.Close()
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/documents?limit=50", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+	var docs []MyDocument
+	if err := json.Unmarshal(body, &docs); err != nil || len(docs) != 1 || resp.Header.Get(HEADER_NEXT_AFTER_KEY) != "key1" {
+		t.Fatalf("expected: limit lowered to 1, got: %s", body)
+	}
+}
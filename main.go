@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"mongo-http-audit-service/src/myLogger"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/rs/zerolog/log"
 )
@@ -23,23 +29,62 @@ const (
 	STATE_PROCESSED = "PROCESSED"
 
 	DocumentCollection = "documentCollection"
+
+	STORAGE_MONGO  = "mongo"
+	STORAGE_FILE   = "file"
+	STORAGE_MEMORY = "memory"
+
+	HEADER_ADMIN_TOKEN = "X-Admin-Token"
 )
 
 type serverContext struct {
-	mongoClient     *mongo.Client
-	dbName          string
-	collectionIndex map[string]bool
+	documents DocumentStore
+	batches   BatchStore
+	webhooks  *webhookDispatcher
+	events    *eventBroker
+	// settings can be replaced by a config reload, see runtime
+	settings atomic.Pointer[runtimeSettings]
+	// tenancy is nil when all the clients share the same documents
+	tenancy *tenancy
+	// startup is nil when the context is built with a ready store. Otherwise the management server answers while main
+	// still sets the other fields: its handlers only read them once ready.
+	startup *startupState
+	// breaker is nil when the calls of the handlers go straight to the store
+	breaker *circuitBreaker
+	// saves is nil when each save is inserted on its own
+	saves *groupCommit
+	// spool is nil when the saves fail while the storage is unavailable
+	spool *documentSpool
+	// adminToken must be in the X-Admin-Token header of the /admin/ routes, they are refused if it is empty
+	adminToken string
 }
 
 type MyDocument struct {
-	ID    *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name  string              `json:"name"`
-	Key   string              `json:"key"`
-	State string              `bson:"state,omitempty" json:"state,omitempty"`
+	ID *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	// TenantID is only saved with tenancy=field, it is never read from or sent to the clients
+	TenantID string `bson:"tenantId,omitempty" json:"-"`
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	State    string `bson:"state,omitempty" json:"state,omitempty"`
+	// Reason and Comment are set by the last state change
+	Reason  string `bson:"reason,omitempty" json:"reason,omitempty"`
+	Comment string `bson:"comment,omitempty" json:"comment,omitempty"`
+	// Version is incremented on each write, it is sent as ETag and checked against If-Match
+	Version int64 `bson:"version,omitempty" json:"version,omitempty"`
+	// Payload is free-form JSON, its size is limited by maxPayloadSize
+	Payload map[string]any    `bson:"payload,omitempty" json:"payload,omitempty"`
+	Labels  map[string]string `bson:"labels,omitempty" json:"labels,omitempty"`
+	// The fields below are maintained by the server
+	CreatedAt      *time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	UpdatedAt      *time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	StateChangedAt *time.Time `bson:"stateChangedAt,omitempty" json:"stateChangedAt,omitempty"`
+	CreatedBy      string     `bson:"createdBy,omitempty" json:"createdBy,omitempty"`
+	UpdatedBy      string     `bson:"updatedBy,omitempty" json:"updatedBy,omitempty"`
 }
 
 type MyDocumentList struct {
 	ID        *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	TenantID  string              `bson:"tenantId,omitempty" json:"-"`
 	ToProcess []MyDocument        `json:"documentList"`
 }
 
@@ -47,6 +92,30 @@ type MyDocumentId struct {
 	ID *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
 }
 
+// setETag sends the version of the document as a strong ETag.
+func setETag(w http.ResponseWriter, doc *MyDocument) {
+	if doc.Version != 0 {
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", doc.Version))
+	}
+}
+
+// ifMatchVersion returns the version in the If-Match header, 0 if there is none or if it is "*".
+func ifMatchVersion(r *http.Request) (int64, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid If-Match (expected a single ETag like \"3\"): %s", value)
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid If-Match (expected a single ETag like \"3\"): %s", value)
+	}
+	return version, nil
+}
+
 func (s *serverContext) rootHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		myLogger.Log.Debug().Msgf("Unknow page: %s", r.URL.Path)
@@ -57,10 +126,15 @@ func (s *serverContext) rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *serverContext) healthHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	if !s.ready() {
+		http.Error(w, "Starting: "+s.startup.get(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.runtime().readTimeout)
 	defer cancel()
 
-	if err := s.mongoClient.Ping(ctx, nil); err != nil {
+	if err := s.documents.Ping(ctx); err != nil {
 		http.Error(w, "MongoDB Unhealthy: "+err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -69,77 +143,158 @@ func (s *serverContext) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("UP"))
 }
 
-func (s *serverContext) ensureIndex(collection *mongo.Collection, ctx context.Context) {
-	myLogger.Log.Debug().Msg("Ensure index start")
-	name := collection.Name()
-	if _, ok := s.collectionIndex[name]; ok {
-		myLogger.Log.Trace().Msg("Ensure index already ok")
-		return
-	}
+// healthDetails is the answer of /health/details.
+type healthDetails struct {
+	Status string `json:"status"`
+	Stage  string `json:"stage"`
+	// Storage is UP or the error of the ping
+	Storage        string        `json:"storage,omitempty"`
+	CircuitBreaker *breakerStats `json:"circuitBreaker,omitempty"`
+	Spool          *spoolStats   `json:"spool,omitempty"`
+}
 
-	indexes := []mongo.IndexModel{
-		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetName("keyIndex")},
+func (s *serverContext) healthDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	details := healthDetails{Status: "UP", Stage: STAGE_READY}
+	if !s.ready() {
+		details.Status, details.Stage = "DOWN", s.startup.get()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), s.runtime().readTimeout)
+		defer cancel()
+		details.Storage = "UP"
+		if err := s.documents.Ping(ctx); err != nil {
+			details.Status, details.Storage = "DOWN", err.Error()
+		}
+		if s.breaker != nil {
+			stats := s.breaker.stats()
+			details.CircuitBreaker = &stats
+		}
+		if s.spool != nil {
+			stats := s.spool.stats()
+			details.Spool = &stats
+		}
 	}
 
-	_, err := collection.Indexes().CreateMany(ctx, indexes)
-	if err != nil {
-		myLogger.Log.Error().Msgf("Could not ensure index already exist. Error: %s", err.Error())
-		return
+	w.Header().Set("Content-Type", "application/json")
+	if details.Status != "UP" {
+		w.WriteHeader(http.StatusServiceUnavailable)
 	}
-
-	myLogger.Log.Debug().Msgf("Ensure index was ok. Adding %s to map", name)
-	s.collectionIndex[name] = true
+	json.NewEncoder(w).Encode(details)
 }
 
 func (s *serverContext) saveHandler(w http.ResponseWriter, r *http.Request) {
-	collection := s.mongoClient.Database(s.dbName).Collection("documentCollection")
-
 	var doc MyDocument
+	s.limitBody(w, r)
 	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
 		myLogger.Log.Error().Msgf("Could not deserialized body :/")
+		if isBodyTooLarge(err) {
+			http.Error(w, "Error: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spooled, err := s.saveDocument(r.Context(), &doc)
+	if err != nil {
+		if circuitOpenResponse(w, err) {
+			return
+		}
+		if errors.Is(err, ErrPayloadTooLarge) {
+			http.Error(w, "Error: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, ErrSaveQueueFull) || errors.Is(err, ErrSpoolFull) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if doc.ID == nil {
-		id := primitive.NewObjectID()
-		doc.ID = &id
+
+	setETag(w, &doc)
+	if spooled {
+		// Accepted, it will be inserted once the storage is back
+		w.WriteHeader(http.StatusAccepted)
 	}
-	doc.State = STATE_INIT
+	json.NewEncoder(w).Encode(doc)
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
-	defer cancel()
-	s.ensureIndex(collection, ctx)
+func (s *serverContext) getDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := s.findDocument(r.Context(), r.PathValue("key"))
+	if err != nil {
+		if circuitOpenResponse(w, err) {
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	res, err := collection.InsertOne(ctx, doc)
+	setETag(w, doc)
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (s *serverContext) changeStateHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := ifMatchVersion(r)
 	if err != nil {
-		myLogger.Log.Error().Msgf("Could not insert document :/")
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req StateChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if res != nil {
-		myLogger.Log.Debug().Msg("Document was inserted")
+	doc, err := s.changeState(r.Context(), r.PathValue("key"), req, version)
+	if err != nil {
+		switch {
+		case circuitOpenResponse(w, err):
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrInvalidStateChange):
+			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStateConflict):
+			http.Error(w, "Error: "+err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrVersionMismatch):
+			http.Error(w, "Error: "+err.Error(), http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
 	}
 
+	setETag(w, doc)
 	json.NewEncoder(w).Encode(doc)
 }
 
+// updateToState is behind the old per-state paths, kept as aliases of PUT /documents/{key}/state: they only move
+// documents from INIT and answer with the match counts.
 func (s *serverContext) updateToState(w http.ResponseWriter, r *http.Request, updateState string) {
 	key := r.PathValue("key")
-	collection := s.mongoClient.Database(s.dbName).Collection(DocumentCollection)
-
-	filter := bson.M{"key": key, "state": STATE_INIT}
-	update := bson.M{
-		"$set": bson.M{
-			"state": updateState,
-		},
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	res, err := collection.UpdateOne(ctx, filter, update)
+	res, err := s.updateState(r.Context(), key, updateState, version)
 	if err != nil {
+		if circuitOpenResponse(w, err) {
+			return
+		}
+		if errors.Is(err, ErrVersionMismatch) {
+			http.Error(w, "Error: "+err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if errors.Is(err, ErrInvalidTransition) {
+			http.Error(w, "Error: "+err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -157,39 +312,26 @@ func (s *serverContext) updateToRejected(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *serverContext) saveBatchHandler(w http.ResponseWriter, r *http.Request) {
-	collection := s.mongoClient.Database(s.dbName).Collection("documentCollectionBatch")
-
 	var doc MyDocumentList
 	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
 		myLogger.Log.Error().Msg("Could not deserialized body to MyDocumentList")
 		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if doc.ID == nil {
-		id := primitive.NewObjectID()
-		doc.ID = &id
-	}
-
-	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
-	defer cancel()
 
-	res, err := collection.InsertOne(ctx, doc)
-	if err != nil {
-		myLogger.Log.Error().Msg("Could not insert document :/")
+	if err := s.saveBatch(r.Context(), &doc); err != nil {
+		if circuitOpenResponse(w, err) {
+			return
+		}
 		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if res != nil {
-		myLogger.Log.Debug().Msgf("Document batch was inserted. Res: %v", res)
-	}
-
 	json.NewEncoder(w).Encode(MyDocumentId{ID: doc.ID})
 }
 
 func (s *serverContext) processBatchHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("documentId")
-	collection := s.mongoClient.Database(s.dbName).Collection("documentCollectionBatch")
 
 	documentId, err := primitive.ObjectIDFromHex(key)
 	if err != nil {
@@ -197,41 +339,15 @@ func (s *serverContext) processBatchHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	ctxRead, cancelRead := context.WithTimeout(r.Context(), 2*time.Second)
-	defer cancelRead()
-
-	var batchDocument MyDocumentList
-	err = collection.FindOne(ctxRead, bson.M{"_id": documentId}).Decode(&batchDocument)
+	res, _, err := s.processBatch(r.Context(), documentId)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+		if circuitOpenResponse(w, err) {
 			return
 		}
-		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	ctxProcess, cancelProcess := context.WithTimeout(r.Context(), 10*time.Second)
-	defer cancelProcess()
-
-	updates := make([]mongo.WriteModel, 0, len(batchDocument.ToProcess))
-
-	// myLogger.Log.Error().Msg("-------To process --------")
-	for i, doc := range batchDocument.ToProcess {
-		myLogger.Log.Debug().Msgf("Update n°%d -> key: %s", i, doc.Key)
-		updates = append(updates,
-			mongo.NewUpdateOneModel().
-				SetFilter(bson.M{"key": doc.Key, "state": bson.M{"$ne": STATE_PROCESSED}}).
-				SetUpdate(bson.M{"$set": bson.M{"state": STATE_PROCESSED}}),
-		)
-	}
-
-	myLogger.Log.Debug().Msgf("Documents to update: %d", len(updates))
-
-	res, err := s.mongoClient.Database(s.dbName).Collection(DocumentCollection).BulkWrite(ctxProcess, updates)
-	if err != nil {
-		bulkErr, ok := err.(mongo.BulkWriteException)
-		if ok {
+		var bulkErr mongo.BulkWriteException
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+		} else if errors.As(err, &bulkErr) {
 			for _, writeErr := range bulkErr.WriteErrors {
 				myLogger.Log.Error().Msgf("[Bulk error] Index: %d | Error: %s", writeErr.Index, writeErr.Message)
 			}
@@ -245,55 +361,306 @@ func (s *serverContext) processBatchHandler(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(res)
 }
 
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// routes of the main server. Each of them must be documented in apiDocs (openapi.go).
+func (ctx *serverContext) routes() []route {
+	routes := []route{
+		{"GET /", ctx.rootHandler},
+		{"POST /save", ctx.saveHandler},
+		{"GET /documents", ctx.listDocumentsHandler},
+		{"GET /documents/{key}", ctx.getDocumentHandler},
+		{"PATCH /documents/{key}", ctx.patchDocumentHandler},
+		{"PUT /documents/{key}/state", ctx.changeStateHandler},
+		{"POST /documents/transition", ctx.bulkTransitionHandler},
+		{"POST /batch/save", ctx.saveBatchHandler},
+		{"PUT /update/{key}/verified", ctx.updateToVerified},
+		{"PUT /update/{key}/rejected", ctx.updateToRejected},
+		{"PUT /process/{documentId}", ctx.processBatchHandler},
+	}
+	if ctx.events != nil {
+		routes = append(routes, route{"GET /events", ctx.eventsHandler})
+	}
+	if ctx.webhooks != nil {
+		routes = append(routes,
+			route{"POST /admin/webhooks", ctx.createWebhookHandler},
+			route{"GET /admin/webhooks", ctx.listWebhooksHandler},
+			route{"DELETE /admin/webhooks/{id}", ctx.deleteWebhookHandler},
+			route{"GET /admin/webhooks/deadletters", ctx.listDeadLettersHandler},
+			route{"POST /admin/webhooks/deadletters/{id}/replay", ctx.replayDeadLetterHandler},
+		)
+	}
+	return routes
+}
+
+// managementRoutes are served on the management port (or on the main one when it is the same port).
+func (ctx *serverContext) managementRoutes() []route {
+	return []route{
+		{"GET /health", ctx.healthHandler},
+		{"GET /health/details", ctx.healthDetailsHandler},
+		{"GET /metrics", ctx.metricsHandler},
+		{"GET /ready", ctx.readyHandler},
+		{"GET /openapi.json", ctx.openApiHandler},
+	}
+}
+
 func (ctx *serverContext) MainServer(hasHealthEndpointOnSamePort bool) *http.ServeMux {
 	mainHttp := http.NewServeMux()
-	mainHttp.HandleFunc("GET /", ctx.rootHandler)
-	mainHttp.HandleFunc("POST /save", ctx.saveHandler)
-	mainHttp.HandleFunc("POST /batch/save", ctx.saveBatchHandler)
-	mainHttp.HandleFunc("PUT /update/{key}/verified", ctx.updateToVerified)
-	mainHttp.HandleFunc("PUT /update/{key}/rejected", ctx.updateToRejected)
-	mainHttp.HandleFunc("PUT /process/{documentId}", ctx.processBatchHandler)
+	// The probes don't have a tenant and must answer while the storage is down, like on the management port
 	if hasHealthEndpointOnSamePort {
-		mainHttp.HandleFunc("GET /health", ctx.healthHandler)
+		for _, r := range ctx.managementRoutes() {
+			mainHttp.HandleFunc(r.pattern, r.handler)
+		}
+	}
+	for _, r := range ctx.routes() {
+		handler := actorHandler(r.handler)
+		if isAdminRoute(r.pattern) {
+			handler = ctx.adminHandler(handler)
+		}
+		if ctx.tenancy != nil {
+			handler = ctx.tenantHandler(handler)
+		}
+		mainHttp.HandleFunc(r.pattern, handler)
 	}
 	return mainHttp
 }
 
-func main() {
-	cfg := getEnvVariables("./properties.json")
-	myLogger.InitLogging(cfg.dev, cfg.levelLog)
-	if cfg.dev {
-		myLogger.Log.Debug().Msgf("Config: %v", cfg)
+func isAdminRoute(pattern string) bool {
+	_, path, _ := strings.Cut(pattern, " ")
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// adminHandler only lets the requests with the admin token through.
+func (ctx *serverContext) adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ctx.adminToken == "" {
+			http.Error(w, "Error: the admin routes are disabled, set adminToken", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(HEADER_ADMIN_TOKEN)), []byte(ctx.adminToken)) != 1 {
+			http.Error(w, "Error: invalid "+HEADER_ADMIN_TOKEN, http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
 	}
+}
 
-	// Init mongo
-	clientOptions := options.Client().ApplyURI(cfg.mongoUri)
-	mongoCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (ctx *serverContext) ManagementServer() *http.ServeMux {
+	managementHttp := http.NewServeMux()
+	for _, r := range ctx.managementRoutes() {
+		managementHttp.HandleFunc(r.pattern, r.handler)
+	}
+	return managementHttp
+}
+
+func main() {
+	configPath := flag.String("config", defaultConfigPath, "config file (.json, .yaml, .yml or .toml)")
+	environment := flag.String("env", os.Getenv(ENV_ENVIRONMENT), "environment whose config file overrides the config, e.g. prod for properties.prod.yaml")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [config print]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	mongoClient, err := mongo.Connect(mongoCtx, clientOptions)
+	cfg, values, err := getEnvVariables(*configPath, *environment)
+	if args := flag.Args(); len(args) > 0 {
+		if len(args) != 2 || args[0] != "config" || args[1] != "print" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		printConfig(os.Stdout, values)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid config:\n%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%s\n", err.Error())
+		os.Exit(1)
 	}
 
-	// Init context
-	ctx := serverContext{mongoClient: mongoClient, dbName: cfg.mongoDb, collectionIndex: make(map[string]bool)}
+	if err := myLogger.Init(logOptions(cfg)); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not init the logs: %s\n", err.Error())
+		os.Exit(1)
+	}
+	for _, secret := range secretValues(values) {
+		myLogger.AddSecret(secret)
+	}
+	if cfg.dev {
+		var config strings.Builder
+		printConfig(&config, values)
+		myLogger.Log.Debug().Msgf("Config:\n%s", config.String())
+	}
 
+	// The management server answers /ready during the startup, the main listener only opens once the store is ready
+	var ctx serverContext
+	ctx.startup = newStartupState()
 	port := fmt.Sprintf(":%s", cfg.port)
 	managementPort := fmt.Sprintf(":%s", cfg.managementPort)
 	samePort := port == managementPort
-
-	mainHttp := ctx.MainServer(samePort)
-
 	if !samePort {
 		go func() {
-			managementHttp := http.NewServeMux()
-			managementHttp.HandleFunc("GET /health", ctx.healthHandler)
+			managementHttp := ctx.ManagementServer()
 			myLogger.Log.Info().Msg("[Health] Server is listening on: http://localhost" + managementPort + "/health")
 			myLogger.Log.Fatal().Err(http.ListenAndServe(managementPort, managementHttp))
 		}()
 	}
 
+	// The event sinks are shared by the change stream and the outbox, a reload can replace them
+	var sinks *reloadableSink
+	if cfg.changeStream || cfg.outbox {
+		eventSinks, err := newEventSinks(cfg.eventSinks)
+		if err != nil {
+			log.Fatal().Msgf("Could not create event sinks: %s", err.Error())
+		}
+		sinks = newReloadableSink(eventSinks)
+	}
+
+	// Init store
+	var store Store
+	// openTenant returns the store of a tenant when tenancy is enabled
+	var openTenant func(tenant string) (Store, error)
+	switch cfg.storageBackend {
+	case STORAGE_MONGO:
+		// Validated with the config
+		clientOptions, _ := mongoClientOptions(cfg)
+		mongoCtx, cancel := context.WithTimeout(context.Background(), cfg.mongoConnectTimeout)
+		defer cancel()
+
+		mongoClient, err := mongo.Connect(mongoCtx, clientOptions)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		mongoStore := newMongoStore(mongoClient, cfg.mongoDb)
+		mongoStore.outbox = cfg.outbox
+		mongoStore.transitionWriteConcern, _ = parseWriteConcern(cfg.mongoTransitionWriteConcern)
+
+		// Connect doesn't reach the server, Mongo may also still be starting
+		startCtx, cancelStart := context.WithTimeout(context.Background(), cfg.mongoStartupTimeout)
+		defer cancelStart()
+		indexStore := mongoStore
+		if cfg.tenancy == TENANCY_FIELD {
+			// The documents of every tenant share the collection and its tenantKeyIndex
+			indexStore = mongoStore.forTenant("", true)
+		}
+		retry := backoff{initial: cfg.mongoRetryDelay, max: cfg.mongoRetryMaxDelay}
+		if err := startMongo(startCtx, indexStore, ctx.startup, retry, cfg.mongoConnectTimeout); err != nil {
+			log.Fatal().Msgf("Could not start with MongoDB: %s", err.Error())
+		}
+		store = mongoStore
+		openTenant = func(tenant string) (Store, error) {
+			return mongoStore.forTenant(tenant, cfg.tenancy == TENANCY_FIELD), nil
+		}
+
+		if cfg.changeStream {
+			go newChangeStreamWatcher("documentStates", mongoStore, sinks).Run(context.Background())
+		}
+	case STORAGE_FILE:
+		fileStore, err := newFileStore(cfg.storagePath)
+		if err != nil {
+			log.Fatal().Msgf("Could not open file store (%s): %s", cfg.storagePath, err.Error())
+		}
+		defer fileStore.Close()
+		fileStore.outbox = cfg.outbox
+		store = fileStore
+		// Each tenant has its own file, whatever the tenancy
+		openTenant = func(tenant string) (Store, error) {
+			return newFileStore(cfg.storagePath + "." + tenant)
+		}
+	case STORAGE_MEMORY:
+		memoryStore := newMemoryStore()
+		memoryStore.outbox = cfg.outbox
+		store = memoryStore
+		openTenant = func(tenant string) (Store, error) {
+			return newMemoryStore(), nil
+		}
+	}
+	if cfg.changeStream && cfg.storageBackend != STORAGE_MONGO {
+		myLogger.Log.Warn().Msgf("changeStream is only available with the %s storageBackend", STORAGE_MONGO)
+	}
+	if cfg.outbox {
+		go newOutboxRelay(store, sinks, cfg.outboxInterval).Run(context.Background())
+	}
+
+	// Init context
+	webhooks := newWebhookDispatcher(store, cfg.webhookMaxAttempts, cfg.webhookRetryDelay, cfg.webhookRetryMaxDelay, cfg.webhookTimeout)
+	webhooks.allowLoopback = cfg.webhookAllowLoopback
+	webhooks.Start(context.Background(), cfg.webhookWorkers)
+	// Validated with the config
+	settings, _ := newRuntimeSettings(cfg)
+	retention, _ := parseRetention(cfg.retention, settings.states)
+	var batchRetention time.Duration
+	if cfg.batchRetention != "" {
+		batchRetention, _ = parseRetentionDuration(cfg.batchRetention)
+	}
+	if len(retention) > 0 || batchRetention > 0 {
+		var archive DocumentArchive
+		switch cfg.archive {
+		case ARCHIVE_COLLECTION:
+			archive = store.(*mongoStore)
+		case ARCHIVE_FILE:
+			archive = &fileArchive{dir: cfg.archivePath}
+		}
+		go newRetentionWorker(store, archive, retention, batchRetention, cfg.retentionInterval).Run(context.Background())
+	}
+
+	ctx.documents, ctx.batches, ctx.webhooks, ctx.events = store, store, webhooks, newEventBroker(cfg.eventHistorySize)
+	ctx.adminToken = cfg.adminToken
+	ctx.settings.Store(settings)
+	if cfg.tenancy != TENANCY_NONE {
+		// Validated with the config
+		allowed, _ := newTenantFilter(cfg.tenants, cfg.tenantPattern)
+		tenants := newTenantRouter(store, openTenant, allowed, cfg.tenantMaxStores)
+		defer tenants.Close()
+		ctx.documents, ctx.batches = tenants, tenants
+		ctx.tenancy = &tenancy{jwtSecret: []byte(cfg.jwtSecret), claim: cfg.tenantClaim, allowed: allowed}
+		if cfg.jwtSecret != "" {
+			myLogger.Log.Info().Msgf("Tenancy: %s (tenant from the claim %s of the bearer token)", cfg.tenancy, cfg.tenantClaim)
+		} else {
+			myLogger.Log.Info().Msgf("Tenancy: %s (tenant from %s)", cfg.tenancy, HEADER_TENANT)
+		}
+	}
+	// Only the calls of the handlers fail fast, the background workers keep retrying on their own
+	if cfg.breakerThreshold > 0 {
+		ctx.breaker = newCircuitBreaker(cfg.breakerThreshold, cfg.breakerOpenDuration, cfg.breakerHalfOpenTrials)
+		breakers := newBreakerStore(ctx.documents, ctx.batches, ctx.breaker)
+		ctx.documents, ctx.batches = breakers, breakers
+	}
+	if cfg.groupCommit {
+		ctx.saves = newGroupCommit(ctx.documents, cfg.groupCommitQueueSize, cfg.groupCommitBatchSize, cfg.groupCommitWindow)
+		go ctx.saves.Run(context.Background())
+	}
+	if cfg.spool {
+		spool, err := openSpool(cfg.spoolPath, cfg.spoolConflictsPath, int64(cfg.spoolMaxSize)*1024*1024)
+		if err != nil {
+			log.Fatal().Msgf("Could not open spool (%s): %s", cfg.spoolPath, err.Error())
+		}
+		defer spool.Close()
+		ctx.spool = spool
+		go newSpoolReplayer(spool, ctx.documents, ctx.emit, cfg.spoolReplayInterval, cfg.writeTimeout).Run(context.Background())
+	}
+
+	go newConfigReloader(*configPath, *environment, cfg, values, &ctx, webhooks, sinks).Run(context.Background())
+
+	mainHttp := ctx.MainServer(samePort)
+	ctx.startup.set(STAGE_READY)
+
+	if cfg.grpcPort != "" {
+		go func() {
+			grpcPort := fmt.Sprintf(":%s", cfg.grpcPort)
+			listener, err := net.Listen("tcp", grpcPort)
+			if err != nil {
+				myLogger.Log.Fatal().Err(err).Msg("[ gRPC ] Could not listen")
+			}
+			myLogger.Log.Info().Msg("[ gRPC ] Server is listening on: localhost" + grpcPort)
+			myLogger.Log.Fatal().Err(ctx.GrpcServer().Serve(listener)).Msg("[ gRPC ] Server stopped")
+		}()
+	}
+
 	myLogger.Log.Info().Msg("[ Main ] Server is listening on: http://localhost" + port)
 	myLogger.Log.Fatal().Err(http.ListenAndServe(port, mainHttp))
 }
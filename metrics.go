@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type metricSample struct {
+	labels string
+	value  any
+}
+
+// writeMetric writes one metric in the Prometheus text format.
+func writeMetric(w io.Writer, name string, kind string, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, sample.labels, sample.value)
+	}
+}
+
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func (s *serverContext) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "audit_ready", "gauge", "1 once the startup is done", metricSample{value: boolMetric(s.ready())})
+	if !s.ready() {
+		return
+	}
+
+	if s.breaker != nil {
+		stats := s.breaker.stats()
+		states := []metricSample{}
+		for _, state := range []string{BREAKER_CLOSED, BREAKER_OPEN, BREAKER_HALF_OPEN} {
+			states = append(states, metricSample{labels: fmt.Sprintf("{state=%q}", state), value: boolMetric(stats.State == state)})
+		}
+		writeMetric(w, "audit_circuit_breaker_state", "gauge", "1 for the current state of the circuit breaker", states...)
+		writeMetric(w, "audit_circuit_breaker_opened_total", "counter", "Times the circuit breaker opened", metricSample{value: stats.Opened})
+		writeMetric(w, "audit_circuit_breaker_rejected_total", "counter", "Storage calls rejected by the open circuit breaker", metricSample{value: stats.Rejected})
+		writeMetric(w, "audit_circuit_breaker_failures_total", "counter", "Storage calls that failed", metricSample{value: stats.Failures})
+	}
+	if s.spool != nil {
+		stats := s.spool.stats()
+		writeMetric(w, "audit_spool_depth", "gauge", "Spooled documents waiting to be replayed", metricSample{value: stats.Depth})
+		writeMetric(w, "audit_spool_conflicts_total", "counter", "Spooled documents refused on replay", metricSample{value: stats.Conflicts})
+	}
+}
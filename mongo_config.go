@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+var mongoCompressors = []string{"snappy", "zlib", "zstd"}
+
+// parseReadPreference returns nil for an empty value, the one of the URI (or primary) is kept.
+func parseReadPreference(value string) (*readpref.ReadPref, error) {
+	if value == "" {
+		return nil, nil
+	}
+	mode, err := readpref.ModeFromString(value)
+	if err != nil {
+		return nil, fmt.Errorf("unknown read preference: %s (expected: primary, primaryPreferred, secondary, secondaryPreferred or nearest)", value)
+	}
+	return readpref.New(mode)
+}
+
+// parseWriteConcern reads "majority" or a number of nodes, nil for an empty value.
+func parseWriteConcern(value string) (*writeconcern.WriteConcern, error) {
+	switch {
+	case value == "":
+		return nil, nil
+	case value == "majority":
+		return writeconcern.Majority(), nil
+	}
+	nodes, err := strconv.Atoi(value)
+	if err != nil || nodes < 0 {
+		return nil, fmt.Errorf("invalid write concern: %s (expected: majority or a number of nodes)", value)
+	}
+	return &writeconcern.WriteConcern{W: nodes}, nil
+}
+
+// parseOptionalBool returns nil for an empty value, the default of the driver is kept.
+func parseOptionalBool(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	res, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid boolean: %s", value)
+	}
+	return &res, nil
+}
+
+func parseCompressors(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	res := []string{}
+	for _, compressor := range strings.Split(value, ",") {
+		compressor = strings.TrimSpace(compressor)
+		if !slices.Contains(mongoCompressors, compressor) {
+			return nil, fmt.Errorf("unknown compressor: %s (expected: %s)", compressor, strings.Join(mongoCompressors, ", "))
+		}
+		res = append(res, compressor)
+	}
+	return res, nil
+}
+
+// mongoClientOptions applies the mongo variables on top of the URI. The variables left empty or at 0 keep the value
+// of the URI or the default of the driver.
+func mongoClientOptions(cfg serverVar) (*options.ClientOptions, error) {
+	clientOptions := options.Client().ApplyURI(cfg.mongoUri)
+	if cfg.mongoUsername != "" {
+		credential := options.Credential{Username: cfg.mongoUsername, Password: cfg.mongoPassword, PasswordSet: cfg.mongoPassword != ""}
+		// Keep the other auth options of the URI (authSource, authMechanism...), the driver drops an authSource
+		// without a user in the URI
+		if clientOptions.Auth != nil {
+			credential.AuthSource, credential.AuthMechanism = clientOptions.Auth.AuthSource, clientOptions.Auth.AuthMechanism
+			credential.AuthMechanismProperties = clientOptions.Auth.AuthMechanismProperties
+		} else if cs, err := connstring.Parse(cfg.mongoUri); err == nil {
+			credential.AuthSource = cs.AuthSource
+		}
+		clientOptions.SetAuth(credential)
+	}
+
+	if cfg.mongoMaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(uint64(cfg.mongoMaxPoolSize))
+	}
+	if cfg.mongoMinPoolSize > 0 {
+		clientOptions.SetMinPoolSize(uint64(cfg.mongoMinPoolSize))
+	}
+	if cfg.mongoMaxConnIdleTime > 0 {
+		clientOptions.SetMaxConnIdleTime(cfg.mongoMaxConnIdleTime)
+	}
+	if cfg.mongoConnectTimeout > 0 {
+		clientOptions.SetConnectTimeout(cfg.mongoConnectTimeout)
+	}
+	if cfg.mongoServerSelectionTimeout > 0 {
+		clientOptions.SetServerSelectionTimeout(cfg.mongoServerSelectionTimeout)
+	}
+
+	readPreference, err := parseReadPreference(cfg.mongoReadPreference)
+	if err != nil {
+		return nil, err
+	}
+	if readPreference != nil {
+		clientOptions.SetReadPreference(readPreference)
+	}
+	writeConcern, err := parseWriteConcern(cfg.mongoWriteConcern)
+	if err != nil {
+		return nil, err
+	}
+	if writeConcern != nil {
+		clientOptions.SetWriteConcern(writeConcern)
+	}
+	retryWrites, err := parseOptionalBool(cfg.mongoRetryWrites)
+	if err != nil {
+		return nil, fmt.Errorf("mongoRetryWrites: %w", err)
+	}
+	if retryWrites != nil {
+		clientOptions.SetRetryWrites(*retryWrites)
+	}
+	retryReads, err := parseOptionalBool(cfg.mongoRetryReads)
+	if err != nil {
+		return nil, fmt.Errorf("mongoRetryReads: %w", err)
+	}
+	if retryReads != nil {
+		clientOptions.SetRetryReads(*retryReads)
+	}
+	compressors, err := parseCompressors(cfg.mongoCompressors)
+	if err != nil {
+		return nil, err
+	}
+	if compressors != nil {
+		clientOptions.SetCompressors(compressors)
+	}
+
+	return clientOptions, clientOptions.Validate()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestMongoClientOptions(t *testing.T) {
+	cfg := serverVar{
+		mongoUri:             "mongodb://localhost:27017/?authSource=audit&maxPoolSize=10",
+		mongoUsername:        "root",
+		mongoPassword:        "password",
+		mongoMaxPoolSize:     50,
+		mongoMaxConnIdleTime: time.Minute,
+		mongoReadPreference:  "secondaryPreferred",
+		mongoWriteConcern:    "majority",
+		mongoRetryWrites:     "false",
+		mongoCompressors:     "zstd,snappy",
+	}
+	clientOptions, err := mongoClientOptions(cfg)
+	if err != nil {
+		t.Fatalf("Could not build client options: %v", err)
+	}
+	if *clientOptions.MaxPoolSize != 50 || *clientOptions.MaxConnIdleTime != time.Minute {
+		t.Fatalf("expected: pool options of the config, got: %d and %s", *clientOptions.MaxPoolSize, *clientOptions.MaxConnIdleTime)
+	}
+	if clientOptions.ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Fatalf("expected: secondaryPreferred, got: %s", clientOptions.ReadPreference.Mode())
+	}
+	if clientOptions.WriteConcern.W != "majority" || *clientOptions.RetryWrites || !slices.Equal(clientOptions.Compressors, []string{"zstd", "snappy"}) {
+		t.Fatalf("expected: write options of the config, got: %v, %v and %v", clientOptions.WriteConcern.W, *clientOptions.RetryWrites, clientOptions.Compressors)
+	}
+	// The credentials are replaced, the auth source of the URI is kept
+	if clientOptions.Auth.Username != "root" || clientOptions.Auth.Password != "password" || clientOptions.Auth.AuthSource != "audit" {
+		t.Fatalf("expected: credentials of the config with the auth source of the URI, got: %+v", *clientOptions.Auth)
+	}
+
+	for _, invalid := range []serverVar{
+		{mongoUri: cfg.mongoUri, mongoReadPreference: "closest"},
+		{mongoUri: cfg.mongoUri, mongoWriteConcern: "all"},
+		{mongoUri: cfg.mongoUri, mongoRetryReads: "maybe"},
+		{mongoUri: cfg.mongoUri, mongoCompressors: "gzip"},
+	} {
+		if _, err := mongoClientOptions(invalid); err == nil {
+			t.Fatalf("expected: error for %+v, got: nil", invalid)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type apiParam struct {
+	name        string
+	in          string
+	description string
+}
+
+type apiResponse struct {
+	description string
+	// body is a value of the returned type (nil for no body, a string for a text/plain body)
+	body any
+}
+
+type apiDoc struct {
+	summary     string
+	tag         string
+	requestBody any
+	params      []apiParam
+	responses   map[int]apiResponse
+}
+
+var (
+	errorResponse    = apiResponse{description: "Error message", body: ""}
+	notFoundResponse = apiResponse{description: "Not found", body: ""}
+
+	ifMatchParam               = apiParam{name: "If-Match", in: "header", description: "ETag of the document, the request fails if it changed since"}
+	preconditionFailedResponse = apiResponse{description: "The document changed since the ETag in If-Match", body: ""}
+
+	adminTokenParam       = apiParam{name: HEADER_ADMIN_TOKEN, in: "header", description: "The adminToken of the config"}
+	unauthorizedResponse  = apiResponse{description: "Missing or invalid " + HEADER_ADMIN_TOKEN, body: ""}
+	adminDisabledResponse = apiResponse{description: "No adminToken in the config", body: ""}
+)
+
+// apiDocs documents every route of routes() and managementRoutes(), indexed by their pattern.
+var apiDocs = map[string]apiDoc{
+	"GET /": {
+		summary:   "Main page",
+		tag:       "main",
+		responses: map[int]apiResponse{200: {description: "Main page", body: ""}, 404: notFoundResponse},
+	},
+	"POST /save": {
+		summary:     "Save a new document in state INIT",
+		tag:         "documents",
+		requestBody: MyDocument{},
+		responses:   map[int]apiResponse{200: {description: "Saved document", body: MyDocument{}}, 202: {description: "Storage unavailable, document spooled to be saved later", body: MyDocument{}}, 400: errorResponse, 413: {description: "Payload larger than maxPayloadSize", body: ""}, 503: {description: "Too many saves waiting with groupCommit, or spool full", body: ""}},
+	},
+	"GET /documents": {
+		summary: "List the documents sorted by key",
+		tag:     "documents",
+		params: []apiParam{
+			{name: "state", in: "query", description: "Only the documents in this state"},
+			{name: "namePrefix", in: "query", description: "Only the names starting with this prefix"},
+			{name: "label", in: "query", description: "Only the documents with this label, as name:value (can be repeated)"},
+			{name: "limit", in: "query", description: "Max number of documents (default: 100, at most maxListingLimit)"},
+			{name: "afterKey", in: "query", description: "Only the documents after this key, from the X-Next-After-Key header of the previous page"},
+		},
+		responses: map[int]apiResponse{200: {description: "Documents, with the afterKey of the next page in X-Next-After-Key when the page is full", body: []MyDocument{}}, 400: errorResponse, 500: errorResponse},
+	},
+	"PATCH /documents/{key}": {
+		summary:     "Update the name, payload and labels of a document with a JSON Merge Patch (application/merge-patch+json)",
+		tag:         "documents",
+		requestBody: map[string]any{},
+		params:      []apiParam{ifMatchParam},
+		responses: map[int]apiResponse{
+			200: {description: "Updated document (with its new ETag)", body: MyDocument{}},
+			400: errorResponse,
+			404: notFoundResponse,
+			409: {description: "The document changed during the update", body: ""},
+			412: preconditionFailedResponse,
+			413: {description: "Payload larger than maxPayloadSize", body: ""},
+			415: {description: "Not a merge patch", body: ""},
+			500: errorResponse,
+		},
+	},
+	"GET /documents/{key}": {
+		summary:   "Get a document by key",
+		tag:       "documents",
+		responses: map[int]apiResponse{200: {description: "Document (its version is sent as ETag)", body: MyDocument{}}, 404: notFoundResponse, 500: errorResponse},
+	},
+	"PUT /documents/{key}/state": {
+		summary:     "Move a document to a new state allowed by the state machine",
+		tag:         "documents",
+		requestBody: StateChangeRequest{},
+		params:      []apiParam{ifMatchParam},
+		responses: map[int]apiResponse{
+			200: {description: "Updated document (with its new ETag)", body: MyDocument{}},
+			400: errorResponse,
+			404: notFoundResponse,
+			409: {description: "Transition not allowed or current state not the expected one", body: ""},
+			412: preconditionFailedResponse,
+			500: errorResponse,
+		},
+	},
+	"POST /documents/transition": {
+		summary:     "Move the documents selected by keys or by a filter to a state, by chunks",
+		tag:         "documents",
+		requestBody: BulkTransitionRequest{},
+		responses:   map[int]apiResponse{200: {description: "Counts of the transition (or of what it would do in dry-run mode)", body: BulkTransitionResult{}}, 400: errorResponse, 500: errorResponse},
+	},
+	"POST /batch/save": {
+		summary:     "Save a list of documents to process later",
+		tag:         "batches",
+		requestBody: MyDocumentList{},
+		responses:   map[int]apiResponse{200: {description: "Id of the batch", body: MyDocumentId{}}, 400: errorResponse},
+	},
+	"PUT /update/{key}/verified": {
+		summary:   "Move a document from INIT to VERIFIED (alias of PUT /documents/{key}/state)",
+		tag:       "documents",
+		params:    []apiParam{ifMatchParam},
+		responses: map[int]apiResponse{200: {description: "Matched and updated counts", body: ""}, 400: errorResponse, 409: {description: "Transition from INIT not allowed", body: ""}, 412: preconditionFailedResponse},
+	},
+	"PUT /update/{key}/rejected": {
+		summary:   "Move a document from INIT to REJECTED (alias of PUT /documents/{key}/state)",
+		tag:       "documents",
+		params:    []apiParam{ifMatchParam},
+		responses: map[int]apiResponse{200: {description: "Matched and updated counts", body: ""}, 400: errorResponse, 409: {description: "Transition from INIT not allowed", body: ""}, 412: preconditionFailedResponse},
+	},
+	"PUT /process/{documentId}": {
+		summary:   "Set the documents of a batch to PROCESSED, from the states allowed to move to it",
+		tag:       "batches",
+		responses: map[int]apiResponse{200: {description: "Bulk write result", body: UpdateResult{}}, 400: errorResponse, 404: notFoundResponse, 500: errorResponse},
+	},
+	"GET /events": {
+		summary: "Server-Sent Events stream of the state changes (text/event-stream, data is a StateChangeEvent)",
+		tag:     "events",
+		params: []apiParam{
+			{name: "state", in: "query", description: "Only these states (repeated or comma separated)"},
+			{name: "keyPrefix", in: "query", description: "Only the keys starting with this prefix"},
+			{name: "lastEventId", in: "query", description: "Resume after this event id (same as the Last-Event-ID header)"},
+			{name: "Last-Event-ID", in: "header", description: "Resume after this event id. The ids are <epoch>-<seq>, an id of an earlier boot of the service replays every kept event"},
+		},
+		responses: map[int]apiResponse{200: {description: "Event stream", body: StateChangeEvent{}}, 400: errorResponse},
+	},
+	"POST /admin/webhooks": {
+		summary:     "Create a webhook subscription",
+		tag:         "webhooks",
+		params:      []apiParam{adminTokenParam},
+		requestBody: WebhookSubscription{},
+		responses:   map[int]apiResponse{201: {description: "Created subscription (without secret)", body: WebhookSubscription{}}, 400: errorResponse, 401: unauthorizedResponse, 403: adminDisabledResponse},
+	},
+	"GET /admin/webhooks": {
+		summary:   "List the webhook subscriptions of the tenant (without secrets)",
+		tag:       "webhooks",
+		params:    []apiParam{adminTokenParam},
+		responses: map[int]apiResponse{200: {description: "Subscriptions", body: []WebhookSubscription{}}, 401: unauthorizedResponse, 403: adminDisabledResponse, 500: errorResponse},
+	},
+	"DELETE /admin/webhooks/{id}": {
+		summary:   "Delete a webhook subscription",
+		tag:       "webhooks",
+		params:    []apiParam{adminTokenParam},
+		responses: map[int]apiResponse{204: {description: "Deleted"}, 400: errorResponse, 401: unauthorizedResponse, 403: adminDisabledResponse, 404: notFoundResponse, 500: errorResponse},
+	},
+	"GET /admin/webhooks/deadletters": {
+		summary:   "List the deliveries that failed too many times",
+		tag:       "webhooks",
+		params:    []apiParam{adminTokenParam},
+		responses: map[int]apiResponse{200: {description: "Dead letters", body: []DeadLetter{}}, 401: unauthorizedResponse, 403: adminDisabledResponse, 500: errorResponse},
+	},
+	"POST /admin/webhooks/deadletters/{id}/replay": {
+		summary:   "Send a dead letter again",
+		tag:       "webhooks",
+		params:    []apiParam{adminTokenParam},
+		responses: map[int]apiResponse{202: {description: "Delivery queued"}, 400: errorResponse, 401: unauthorizedResponse, 403: adminDisabledResponse, 404: notFoundResponse, 500: errorResponse},
+	},
+	"GET /health": {
+		summary:   "Health of the server and its storage",
+		tag:       "management",
+		responses: map[int]apiResponse{200: {description: "UP", body: ""}, 503: errorResponse},
+	},
+	"GET /health/details": {
+		summary:   "Startup stage, storage, circuit breaker and spool state",
+		tag:       "management",
+		responses: map[int]apiResponse{200: {description: "Details", body: healthDetails{}}, 503: {description: "Details of what is down", body: healthDetails{}}},
+	},
+	"GET /metrics": {
+		summary:   "Metrics in the Prometheus text format",
+		tag:       "management",
+		responses: map[int]apiResponse{200: {description: "Metrics", body: ""}},
+	},
+	"GET /ready": {
+		summary:   "Readiness of the server, 503 with the startup stage until the storage is ready",
+		tag:       "management",
+		responses: map[int]apiResponse{200: {description: "READY", body: ""}, 503: errorResponse},
+	},
+	"GET /openapi.json": {
+		summary:   "This document",
+		tag:       "management",
+		responses: map[int]apiResponse{200: {description: "OpenAPI 3 document", body: map[string]any{}}},
+	},
+}
+
+var pathParamRegexp = regexp.MustCompile(`\{(\w+)\}`)
+
+// openApiBuilder generates the schemas of the Go types, the named structs go in components.
+type openApiBuilder struct {
+	schemas map[string]any
+}
+
+func (b *openApiBuilder) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(primitive.ObjectID{}):
+		return map[string]any{"type": "string", "pattern": "^[0-9a-f]{24}$"}
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// Placeholder first for recursive types
+			b.schemas[t.Name()] = map[string]any{}
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (b *openApiBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (b *openApiBuilder) content(body any) map[string]any {
+	if _, ok := body.(string); ok {
+		return map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+	}
+	return map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(body))}}
+}
+
+func (b *openApiBuilder) operation(pattern string, doc apiDoc) map[string]any {
+	var parameters []any
+	for _, match := range pathParamRegexp.FindAllStringSubmatch(pattern, -1) {
+		parameters = append(parameters, map[string]any{"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	for _, param := range doc.params {
+		parameters = append(parameters, map[string]any{"name": param.name, "in": param.in, "description": param.description, "schema": map[string]any{"type": "string"}})
+	}
+
+	responses := map[string]any{}
+	for code, response := range doc.responses {
+		res := map[string]any{"description": response.description}
+		if response.body != nil {
+			res["content"] = b.content(response.body)
+		}
+		responses[strconv.Itoa(code)] = res
+	}
+
+	operation := map[string]any{"summary": doc.summary, "tags": []string{doc.tag}, "responses": responses}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if doc.requestBody != nil {
+		operation["requestBody"] = map[string]any{"required": true, "content": b.content(doc.requestBody)}
+	}
+	return operation
+}
+
+// openApi returns the OpenAPI 3 document of the given routes. The routes without apiDocs are returned as undocumented.
+func openApi(routes []route) (map[string]any, []string) {
+	builder := &openApiBuilder{schemas: map[string]any{}}
+	paths := map[string]map[string]any{}
+	var undocumented []string
+
+	for _, r := range routes {
+		method, path, _ := strings.Cut(r.pattern, " ")
+		doc, ok := apiDocs[r.pattern]
+		if !ok {
+			undocumented = append(undocumented, r.pattern)
+			continue
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(method)] = builder.operation(path, doc)
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Mongo http audit service",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": builder.schemas},
+	}, undocumented
+}
+
+func (ctx *serverContext) openApiHandler(w http.ResponseWriter, r *http.Request) {
+	if !ctx.ready() {
+		http.Error(w, "Starting: "+ctx.startup.get(), http.StatusServiceUnavailable)
+		return
+	}
+	document, _ := openApi(append(ctx.routes(), ctx.managementRoutes()...))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenApiDocumentsEveryRoute(t *testing.T) {
+	store := newMemoryStore()
+	ctx := &serverContext{documents: store, batches: store, webhooks: newWebhookDispatcher(store, 1, 0, time.Second, 5*time.Second), events: newEventBroker(1)}
+
+	_, undocumented := openApi(append(ctx.routes(), ctx.managementRoutes()...))
+	if len(undocumented) > 0 {
+		t.Fatalf("expected: every route in apiDocs, got undocumented: %v", undocumented)
+	}
+}
+
+func TestOpenApiHandler(t *testing.T) {
+	url := newTestServer(t, memoryStoreFactory)
+	resp, body := doRequest(t, http.MethodGet, url+"/openapi.json", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	var document struct {
+		OpenApi    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(body, &document); err != nil {
+		t.Fatalf("Could not deserialized OpenAPI document: %v", err)
+	}
+
+	for pattern := range apiDocs {
+		method, path, _ := strings.Cut(pattern, " ")
+		if _, ok := document.Paths[path][strings.ToLower(method)]; !ok {
+			t.Fatalf("expected: %s in the document, got paths: %v", pattern, document.Paths)
+		}
+	}
+	for _, schema := range []string{"MyDocument", "MyDocumentList", "MyDocumentId", "StateChangeEvent", "WebhookSubscription", "DeadLetter"} {
+		if _, ok := document.Components.Schemas[schema]; !ok {
+			t.Fatalf("expected: schema %s in the components, got: %v", schema, document.Components.Schemas)
+		}
+	}
+}
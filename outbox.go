@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"mongo-http-audit-service/src/myLogger"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const OutboxCollection = "outbox"
+
+// OutboxEntry is an event waiting to be sent to the sinks. It is written in the same transaction as the
+// state change so the event can't be lost if the process stops right after the write.
+type OutboxEntry struct {
+	ID        *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Key       string              `bson:"key" json:"key"`
+	Event     StateChangeEvent    `bson:"event" json:"event"`
+	CreatedAt time.Time           `bson:"createdAt" json:"createdAt"`
+}
+
+func newOutboxEntries(events []StateChangeEvent) []OutboxEntry {
+	entries := make([]OutboxEntry, 0, len(events))
+	for _, event := range events {
+		id := primitive.NewObjectID()
+		entries = append(entries, OutboxEntry{ID: &id, Key: event.Key, Event: event, CreatedAt: event.Time})
+	}
+	return entries
+}
+
+// outboxRelay sends the outbox entries to the sink and deletes the delivered ones. Delivery is at least once:
+// an entry sent right before a crash is sent again. When an entry of a key fails, the next entries of the same key
+// wait for the next pass so each key keeps its order.
+type outboxRelay struct {
+	store     OutboxStore
+	sink      EventSink
+	interval  time.Duration
+	batchSize int
+}
+
+func newOutboxRelay(store OutboxStore, sink EventSink, interval time.Duration) *outboxRelay {
+	return &outboxRelay{store: store, sink: sink, interval: interval, batchSize: 500}
+}
+
+// Run drains the outbox every interval until ctx is done.
+func (r *outboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			delivered, err := r.drain(ctx)
+			if err != nil {
+				myLogger.For("outbox").Error().Msgf("[Outbox] Could not drain outbox: %s", err.Error())
+			}
+			// A full batch means there are probably more entries waiting
+			if err != nil || delivered < r.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain sends one batch of entries and returns how many were delivered.
+func (r *outboxRelay) drain(ctx context.Context) (int, error) {
+	listCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	entries, err := r.store.ListOutbox(listCtx, r.batchSize)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	blockedKeys := make(map[string]bool)
+	delivered := make([]primitive.ObjectID, 0, len(entries))
+	for _, entry := range entries {
+		if blockedKeys[entry.Key] {
+			continue
+		}
+		if err := r.sink.Publish(ctx, entry.Event); err != nil {
+			myLogger.For("outbox").Warn().Msgf("[Outbox] Could not publish event %s (%s): %s", entry.Event.Type, entry.Key, err.Error())
+			blockedKeys[entry.Key] = true
+			continue
+		}
+		delivered = append(delivered, *entry.ID)
+	}
+
+	if len(delivered) > 0 {
+		deleteCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := r.store.DeleteOutbox(deleteCtx, delivered); err != nil {
+			return 0, err
+		}
+		myLogger.For("outbox").Debug().Msgf("[Outbox] %d events delivered", len(delivered))
+	}
+	return len(delivered), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type recordingSink struct {
+	mu       sync.Mutex
+	failKeys map[string]bool
+	events   []StateChangeEvent
+}
+
+func (s *recordingSink) Publish(ctx context.Context, event StateChangeEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failKeys[event.Key] {
+		return errors.New("sink unavailable")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+	defer cancel()
+
+	store := newMemoryStore()
+	store.outbox = true
+	for _, key := range []string{"key1", "key2"} {
+		if err := store.InsertDocument(ctx, &MyDocument{Name: "name", Key: key, State: STATE_INIT}); err != nil {
+			t.Fatalf("Could not insert document %s: %v", key, err)
+		}
+	}
+	store.UpdateState(ctx, "key1", STATE_INIT, 0, StateChange{State: STATE_VERIFIED})
+	store.UpdateState(ctx, "key2", STATE_VERIFIED, 0, StateChange{State: STATE_REJECTED})
+	store.ProcessDocuments(ctx, []string{"key1", "key2"}, defaultStateMachine.sources(STATE_PROCESSED), "")
+
+	entries, _ := store.ListOutbox(ctx, 100)
+	if len(entries) != 5 {
+		t.Fatalf("expected: 5 outbox entries, got: %d", len(entries))
+	}
+
+	sink := &recordingSink{failKeys: map[string]bool{"key1": true}}
+	relay := newOutboxRelay(store, sink, time.Hour)
+	delivered, err := relay.drain(ctx)
+	if err != nil || delivered != 2 {
+		t.Fatalf("expected: the 2 events of key2 delivered, got: %d (err: %v)", delivered, err)
+	}
+
+	sink.failKeys = nil
+	if delivered, err := relay.drain(ctx); err != nil || delivered != 3 {
+		t.Fatalf("expected: the 3 events of key1 delivered, got: %d (err: %v)", delivered, err)
+	}
+	if entries, _ := store.ListOutbox(ctx, 100); len(entries) != 0 {
+		t.Fatalf("expected: delivered entries to be deleted, got: %d", len(entries))
+	}
+
+	var key1States []string
+	for _, event := range sink.events {
+		if event.Key == "key1" {
+			key1States = append(key1States, event.State)
+		}
+	}
+	if len(key1States) != 3 || key1States[0] != STATE_INIT || key1States[1] != STATE_VERIFIED || key1States[2] != STATE_PROCESSED {
+		t.Fatalf("expected: key1 events in order INIT, VERIFIED, PROCESSED, got: %v", key1States)
+	}
+}
+
+func TestOutboxFileStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "store.wal")
+
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Could not open file store: %v", err)
+	}
+	store.outbox = true
+	store.InsertDocument(ctx, &MyDocument{Name: "name", Key: "key1", State: STATE_INIT})
+	store.UpdateState(ctx, "key1", STATE_INIT, 0, StateChange{State: STATE_VERIFIED})
+	store.Close()
+
+	store, err = newFileStore(path)
+	if err != nil {
+		t.Fatalf("Could not reopen file store: %v", err)
+	}
+	defer store.Close()
+
+	entries, _ := store.ListOutbox(ctx, 100)
+	if len(entries) != 2 || entries[0].Event.State != STATE_INIT || entries[1].Event.State != STATE_VERIFIED {
+		t.Fatalf("expected: the 2 outbox entries to be reloaded in order, got: %+v", entries)
+	}
+	if err := store.DeleteOutbox(ctx, []primitive.ObjectID{*entries[0].ID}); err != nil {
+		t.Fatalf("Could not delete outbox entry: %v", err)
+	}
+}
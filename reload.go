@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mongo-http-audit-service/src/myLogger"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloadableVariable is a variable that can change without restart, copy records its new value in the running config.
+type reloadableVariable struct {
+	name string
+	copy func(to *serverVar, from serverVar)
+}
+
+// reloadableVariables can change without restart, a change of the other variables is ignored until the next start.
+var reloadableVariables = []reloadableVariable{
+	{"levelLog", func(to *serverVar, from serverVar) { to.levelLog = from.levelLog }},
+	{"logLevels", func(to *serverVar, from serverVar) { to.logLevels = from.logLevels }},
+	{"maxPayloadSize", func(to *serverVar, from serverVar) { to.maxPayloadSize = from.maxPayloadSize }},
+	{"maxListingLimit", func(to *serverVar, from serverVar) { to.maxListingLimit = from.maxListingLimit }},
+	{"stateTransitions", func(to *serverVar, from serverVar) { to.stateTransitions = from.stateTransitions }},
+	{"readTimeout", func(to *serverVar, from serverVar) { to.readTimeout = from.readTimeout }},
+	{"writeTimeout", func(to *serverVar, from serverVar) { to.writeTimeout = from.writeTimeout }},
+	{"bulkTimeout", func(to *serverVar, from serverVar) { to.bulkTimeout = from.bulkTimeout }},
+	{"webhookMaxAttempts", func(to *serverVar, from serverVar) { to.webhookMaxAttempts = from.webhookMaxAttempts }},
+	{"webhookRetryDelay", func(to *serverVar, from serverVar) { to.webhookRetryDelay = from.webhookRetryDelay }},
+	{"webhookRetryMaxDelay", func(to *serverVar, from serverVar) { to.webhookRetryMaxDelay = from.webhookRetryMaxDelay }},
+	{"webhookTimeout", func(to *serverVar, from serverVar) { to.webhookTimeout = from.webhookTimeout }},
+	{"eventSinks", func(to *serverVar, from serverVar) { to.eventSinks = from.eventSinks }},
+}
+
+func isReloadable(name string) bool {
+	return slices.ContainsFunc(reloadableVariables, func(variable reloadableVariable) bool { return variable.name == name })
+}
+
+// runtimeSettings are the settings of the handlers that a reload replaces all at once.
+type runtimeSettings struct {
+	states stateMachine
+	// maxPayloadSize is the max size of MyDocument.Payload in JSON, 0 for no limit
+	maxPayloadSize int
+	// maxListingLimit is the max limit of GET /documents, a larger one is lowered to it
+	maxListingLimit int
+	// readTimeout bounds the reads of one document or batch, writeTimeout the writes of one document or batch, and
+	// bulkTimeout the listings and the operations on many documents (for each chunk of a bulk transition)
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	bulkTimeout  time.Duration
+}
+
+var defaultRuntimeSettings = runtimeSettings{states: defaultStateMachine, maxListingLimit: 1000, readTimeout: 2 * time.Second, writeTimeout: 2 * time.Second, bulkTimeout: 10 * time.Second}
+
+// runtime returns the current settings, the defaults if none were set.
+func (s *serverContext) runtime() *runtimeSettings {
+	if settings := s.settings.Load(); settings != nil {
+		return settings
+	}
+	return &defaultRuntimeSettings
+}
+
+func newRuntimeSettings(cfg serverVar) (*runtimeSettings, error) {
+	states, err := parseStateMachine(cfg.stateTransitions)
+	if err != nil {
+		return nil, err
+	}
+	return &runtimeSettings{states: states, maxPayloadSize: cfg.maxPayloadSize, maxListingLimit: cfg.maxListingLimit,
+		readTimeout: cfg.readTimeout, writeTimeout: cfg.writeTimeout, bulkTimeout: cfg.bulkTimeout}, nil
+}
+
+// reloadableSink sends the events to sinks that a reload can replace.
+type reloadableSink struct {
+	sinks atomic.Pointer[multiSink]
+}
+
+func newReloadableSink(sinks multiSink) *reloadableSink {
+	res := &reloadableSink{}
+	res.sinks.Store(&sinks)
+	return res
+}
+
+func (s *reloadableSink) Publish(ctx context.Context, event StateChangeEvent) error {
+	return s.sinks.Load().Publish(ctx, event)
+}
+
+// swap replaces the sinks and closes the files of the previous ones.
+func (s *reloadableSink) swap(sinks multiSink) {
+	previous := s.sinks.Swap(&sinks)
+	for _, sink := range *previous {
+		if writer, ok := sink.(*writerSink); ok && writer.writer != os.Stdout {
+			if closer, ok := writer.writer.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
+}
+
+// configReloader reloads the config on SIGHUP or when one of its files changes, then applies the reloadable
+// variables. An invalid config is rejected as a whole.
+type configReloader struct {
+	configPath  string
+	environment string
+	interval    time.Duration
+
+	ctx      *serverContext
+	webhooks *webhookDispatcher
+	// sinks is nil when no component publishes events
+	sinks *reloadableSink
+
+	cfg     serverVar
+	values  []configValue
+	modTime time.Time
+}
+
+func newConfigReloader(configPath string, environment string, cfg serverVar, values []configValue, ctx *serverContext, webhooks *webhookDispatcher, sinks *reloadableSink) *configReloader {
+	r := &configReloader{configPath: configPath, environment: environment, interval: cfg.configWatchInterval,
+		ctx: ctx, webhooks: webhooks, sinks: sinks, cfg: cfg, values: values}
+	r.modTime = r.lastModTime()
+	return r
+}
+
+// lastModTime returns the most recent modification time of the config files.
+func (r *configReloader) lastModTime() time.Time {
+	paths := []string{r.configPath}
+	if r.environment != "" {
+		paths = append(paths, overlayPaths(r.configPath, r.environment)...)
+	}
+	var res time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(res) {
+			res = info.ModTime()
+		}
+	}
+	return res
+}
+
+// Run reloads on SIGHUP, and when the files change if interval is not 0, until ctx is done.
+func (r *configReloader) Run(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var poll <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			myLogger.For("config").Info().Msg("[Config] SIGHUP received, reloading the config")
+			r.reload()
+		case <-poll:
+			if modTime := r.lastModTime(); !modTime.Equal(r.modTime) {
+				r.modTime = modTime
+				myLogger.For("config").Info().Msg("[Config] Config file changed, reloading the config")
+				r.reload()
+			}
+		}
+	}
+}
+
+// reload applies the new config and returns false if it was rejected.
+func (r *configReloader) reload() bool {
+	cfg, values, err := getEnvVariables(r.configPath, r.environment)
+	if err != nil {
+		myLogger.For("config").Error().Msgf("[Config] Invalid config, keeping the current one: %s", err.Error())
+		return false
+	}
+
+	for _, secret := range secretValues(values) {
+		myLogger.AddSecret(secret)
+	}
+
+	// Everything that can fail is prepared before anything is applied
+	settings, err := newRuntimeSettings(cfg)
+	if err != nil {
+		myLogger.For("config").Error().Msgf("[Config] Invalid config, keeping the current one: %s", err.Error())
+		return false
+	}
+	var sinks multiSink
+	sinksChanged := r.sinks != nil && cfg.eventSinks != r.cfg.eventSinks
+	if sinksChanged {
+		if sinks, err = newEventSinks(cfg.eventSinks); err != nil {
+			myLogger.For("config").Error().Msgf("[Config] Invalid eventSinks, keeping the current config: %s", err.Error())
+			return false
+		}
+	}
+
+	current := map[string]configValue{}
+	for _, value := range r.values {
+		current[value.name] = value
+	}
+	for _, value := range values {
+		if previous, ok := current[value.name]; ok && previous.value != value.value && !isReloadable(value.name) {
+			myLogger.For("config").Warn().Msgf("[Config] %s can't change without restart, the change is ignored", value.name)
+		}
+	}
+
+	// Validated with the config
+	levels, _ := parseLogLevels(cfg.logLevels)
+	myLogger.SetLevels(cfg.levelLog, levels)
+	r.ctx.settings.Store(settings)
+	r.webhooks.configure(cfg.webhookMaxAttempts, cfg.webhookRetryDelay, cfg.webhookRetryMaxDelay, cfg.webhookTimeout)
+	if sinksChanged {
+		r.sinks.swap(sinks)
+	}
+
+	// The ignored variables keep their value so their change is reported once
+	for i, value := range values {
+		if previous, ok := current[value.name]; ok && !isReloadable(value.name) {
+			values[i] = previous
+		}
+	}
+	for _, variable := range reloadableVariables {
+		variable.copy(&r.cfg, cfg)
+	}
+	r.values = values
+	myLogger.For("config").Info().Msg("[Config] Config reloaded")
+	return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfigFileIn(t, dir, "properties.yaml", "serverPort: 8000\nmaxPayloadSize: 1024\nwebhookMaxAttempts: 2\neventSinks: file:"+filepath.Join(dir, "events1.ndjson")+"\n")
+	cfg, values, err := getEnvVariables(path, "")
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+
+	store := newMemoryStore()
+	webhooks := newWebhookDispatcher(store, cfg.webhookMaxAttempts, cfg.webhookRetryDelay, cfg.webhookRetryMaxDelay, cfg.webhookTimeout)
+	ctx := &serverContext{documents: store, batches: store, webhooks: webhooks, events: newEventBroker(1)}
+	settings, _ := newRuntimeSettings(cfg)
+	ctx.settings.Store(settings)
+	eventSinks, err := newEventSinks(cfg.eventSinks)
+	if err != nil {
+		t.Fatalf("Could not create event sinks: %v", err)
+	}
+	sinks := newReloadableSink(eventSinks)
+	reloader := newConfigReloader(path, "", cfg, values, ctx, webhooks, sinks)
+
+	writeConfigFileIn(t, dir, "properties.yaml", "serverPort: 9000\nmaxPayloadSize: 2048\nwebhookMaxAttempts: 7\nwriteTimeout: 3s\nstateTransitions: INIT>DONE\neventSinks: file:"+filepath.Join(dir, "events2.ndjson")+"\n")
+	if !reloader.reload() {
+		t.Fatalf("expected: config reloaded")
+	}
+	runtime := ctx.runtime()
+	if runtime.maxPayloadSize != 2048 || runtime.writeTimeout != 3*time.Second || !runtime.states.allows(STATE_INIT, "DONE") {
+		t.Fatalf("expected: new runtime settings, got: %+v", runtime)
+	}
+	if _, maxAttempts, _ := webhooks.settings(); maxAttempts != 7 {
+		t.Fatalf("expected: 7 webhook attempts, got: %d", maxAttempts)
+	}
+	// The port needs a restart
+	if reloader.cfg.port != "8000" || reloader.cfg.maxPayloadSize != 2048 || reloader.cfg.stateTransitions != "INIT>DONE" {
+		t.Fatalf("expected: port 8000 kept and the reloaded variables recorded, got: %+v", reloader.cfg)
+	}
+	for _, variable := range reloadableVariables {
+		if !slices.ContainsFunc(values, func(value configValue) bool { return value.name == variable.name }) {
+			t.Fatalf("expected: %s to be a config variable", variable.name)
+		}
+	}
+	if err := sinks.Publish(context.TODO(), newStateChangeEvent("key1", "DONE")); err != nil {
+		t.Fatalf("Could not publish: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "events2.ndjson")); len(content) == 0 {
+		t.Fatalf("expected: event written by the new sink")
+	}
+
+	// An invalid config changes nothing
+	writeConfigFileIn(t, dir, "properties.yaml", "maxPayloadSize: 4096\nbulkTimeout: -1s\n")
+	if reloader.reload() {
+		t.Fatalf("expected: invalid config rejected")
+	}
+	if ctx.runtime().maxPayloadSize != 2048 {
+		t.Fatalf("expected: maxPayloadSize 2048 kept, got: %d", ctx.runtime().maxPayloadSize)
+	}
+}
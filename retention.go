@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ARCHIVE_NONE       = "none"
+	ARCHIVE_COLLECTION = "collection"
+	ARCHIVE_FILE       = "file"
+
+	DocumentCollectionArchive = "documentCollectionArchive"
+)
+
+// retentionPolicy deletes the documents that are in State since more than MaxAge.
+type retentionPolicy struct {
+	State  string
+	MaxAge time.Duration
+}
+
+// parseRetentionDuration accepts the durations of time.ParseDuration and a number of days like 90d.
+func parseRetentionDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.Atoi(days)
+		if err != nil || count <= 0 {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return duration, nil
+}
+
+// parseRetention reads policies like "PROCESSED=90d,REJECTED=30d". The states must be known by the state machine.
+func parseRetention(config string, machine stateMachine) ([]retentionPolicy, error) {
+	policies := []retentionPolicy{}
+	if strings.TrimSpace(config) == "" {
+		return policies, nil
+	}
+	for _, value := range strings.Split(config, ",") {
+		state, age, ok := strings.Cut(strings.TrimSpace(value), "=")
+		state = strings.ToUpper(strings.TrimSpace(state))
+		if !ok || state == "" {
+			return nil, fmt.Errorf("invalid retention: %s (expected: STATE=duration)", value)
+		}
+		if !machine.isKnown(state) {
+			return nil, fmt.Errorf("invalid retention: unknown state %s", state)
+		}
+		maxAge, err := parseRetentionDuration(age)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention: %s: %w", value, err)
+		}
+		policies = append(policies, retentionPolicy{State: state, MaxAge: maxAge})
+	}
+	return policies, nil
+}
+
+// DocumentArchive keeps a copy of the documents before the retention deletes them. Archiving the same document
+// twice must not fail: a pass stopped between the archive and the delete archives it again.
+type DocumentArchive interface {
+	ArchiveDocuments(ctx context.Context, docs []MyDocument) error
+}
+
+// fileArchive writes each archived chunk in a new gzipped NDJSON file of dir.
+type fileArchive struct {
+	dir string
+}
+
+// archivedDocument keeps the tenant that MyDocument doesn't encode in JSON.
+type archivedDocument struct {
+	Tenant string `json:"tenant,omitempty"`
+	*MyDocument
+}
+
+func (a *fileArchive) ArchiveDocuments(ctx context.Context, docs []MyDocument) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("archive-%s.ndjson.gz", time.Now().UTC().Format("20060102T150405.000000000"))
+	path := filepath.Join(a.dir, name)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	zip := gzip.NewWriter(file)
+	writer := bufio.NewWriter(zip)
+	encoder := json.NewEncoder(writer)
+	for i := range docs {
+		if err := encoder.Encode(archivedDocument{Tenant: docs[i].TenantID, MyDocument: &docs[i]}); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := zip.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	// The documents are deleted right after, the file must be on disk first
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// retentionWorker archives then deletes the expired documents, and deletes the expired batches, every interval.
+type retentionWorker struct {
+	store          Store
+	archive        DocumentArchive
+	policies       []retentionPolicy
+	batchRetention time.Duration
+	interval       time.Duration
+	chunkSize      int
+}
+
+func newRetentionWorker(store Store, archive DocumentArchive, policies []retentionPolicy, batchRetention time.Duration, interval time.Duration) *retentionWorker {
+	return &retentionWorker{store: store, archive: archive, policies: policies, batchRetention: batchRetention, interval: interval, chunkSize: 500}
+}
+
+// Run applies the retention every interval until ctx is done.
+func (r *retentionWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.apply(ctx, time.Now()); err != nil {
+			myLogger.For("retention").Error().Msgf("[Retention] Could not apply the retention: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply deletes what is expired at now.
+func (r *retentionWorker) apply(ctx context.Context, now time.Time) error {
+	for _, policy := range r.policies {
+		deleted, err := r.applyPolicy(ctx, policy, now.Add(-policy.MaxAge))
+		if deleted > 0 {
+			myLogger.For("retention").Info().Msgf("[Retention] %d %s documents deleted", deleted, policy.State)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.batchRetention > 0 {
+		deleteCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		deleted, err := r.store.DeleteBatches(deleteCtx, now.Add(-r.batchRetention))
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			myLogger.For("retention").Info().Msgf("[Retention] %d batches deleted", deleted)
+		}
+	}
+	return nil
+}
+
+// applyPolicy works by chunks so a large backlog doesn't load every document in memory.
+func (r *retentionWorker) applyPolicy(ctx context.Context, policy retentionPolicy, before time.Time) (int64, error) {
+	var total int64
+	for {
+		query := DocumentQuery{State: policy.State, StateChangedBefore: &before, Limit: r.chunkSize}
+		chunkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		deleted, found, err := r.applyChunk(chunkCtx, query)
+		cancel()
+		total += deleted
+		if err != nil || found < r.chunkSize {
+			return total, err
+		}
+	}
+}
+
+func (r *retentionWorker) applyChunk(ctx context.Context, query DocumentQuery) (int64, int, error) {
+	docs, err := r.store.FindDocuments(ctx, query)
+	if err != nil || len(docs) == 0 {
+		return 0, 0, err
+	}
+	if r.archive != nil {
+		if err := r.archive.ArchiveDocuments(ctx, docs); err != nil {
+			return 0, len(docs), err
+		}
+	}
+
+	// Only the archived documents, a key can be shared by the tenants. Still filtered by state and time: a document
+	// changed since it was read is kept.
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, *doc.ID)
+	}
+	query.IDs, query.Limit = ids, 0
+	deleted, err := r.store.DeleteDocuments(ctx, query)
+	return deleted, len(docs), err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRetention(t *testing.T) {
+	policies, err := parseRetention("processed=90d, REJECTED=12h", defaultStateMachine)
+	if err != nil {
+		t.Fatalf("Could not parse retention: %v", err)
+	}
+	expected := []retentionPolicy{{State: STATE_PROCESSED, MaxAge: 90 * 24 * time.Hour}, {State: STATE_REJECTED, MaxAge: 12 * time.Hour}}
+	if len(policies) != len(expected) || policies[0] != expected[0] || policies[1] != expected[1] {
+		t.Fatalf("expected: %v, got: %v", expected, policies)
+	}
+
+	for _, config := range []string{"PROCESSED", "UNKNOWN=1d", "PROCESSED=0d", "PROCESSED=-1h", "PROCESSED=soon"} {
+		if _, err := parseRetention(config, defaultStateMachine); err == nil {
+			t.Fatalf("expected: error for %q, got: nil", config)
+		}
+	}
+}
+
+func readArchive(t *testing.T, dir string) []MyDocument {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ndjson.gz"))
+	if err != nil {
+		t.Fatalf("Could not list archive: %v", err)
+	}
+	docs := []MyDocument{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Could not open archive: %v", err)
+		}
+		zip, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Could not read archive: %v", err)
+		}
+		scanner := bufio.NewScanner(zip)
+		for scanner.Scan() {
+			var doc MyDocument
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				t.Fatalf("Could not decode archived document: %v", err)
+			}
+			docs = append(docs, doc)
+		}
+		file.Close()
+	}
+	return docs
+}
+
+func TestRetentionWorker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	archiveDir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+	defer cancel()
+
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Could not open file store: %v", err)
+	}
+	current := time.Now()
+	old := current.Add(-48 * time.Hour)
+	recent := current.Add(-time.Hour)
+	docs := []MyDocument{
+		{Key: "old-processed", State: STATE_PROCESSED, StateChangedAt: &old},
+		{Key: "recent-processed", State: STATE_PROCESSED, StateChangedAt: &recent},
+		{Key: "old-verified", State: STATE_VERIFIED, StateChangedAt: &old},
+	}
+	// Saved before stateChangedAt existed: the time of the id is used
+	oldID := primitive.NewObjectIDFromTimestamp(old)
+	docs = append(docs, MyDocument{ID: &oldID, Key: "legacy-processed", State: STATE_PROCESSED})
+	for _, doc := range docs {
+		if err := store.InsertDocument(ctx, &doc); err != nil {
+			t.Fatalf("Could not insert document %s: %v", doc.Key, err)
+		}
+	}
+	oldBatchID := primitive.NewObjectIDFromTimestamp(old)
+	for _, batch := range []MyDocumentList{{ID: &oldBatchID}, {}} {
+		if err := store.InsertBatch(ctx, &batch); err != nil {
+			t.Fatalf("Could not insert batch: %v", err)
+		}
+	}
+
+	worker := newRetentionWorker(store, &fileArchive{dir: archiveDir}, []retentionPolicy{{State: STATE_PROCESSED, MaxAge: 24 * time.Hour}}, 24*time.Hour, time.Hour)
+	worker.chunkSize = 1
+	if err := worker.apply(ctx, current); err != nil {
+		t.Fatalf("Could not apply retention: %v", err)
+	}
+	store.Close()
+
+	// The deletions are in the log
+	store, err = newFileStore(path)
+	if err != nil {
+		t.Fatalf("Could not reopen file store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"old-processed", "legacy-processed"} {
+		if _, err := store.FindDocument(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected: %s deleted, got: %v", key, err)
+		}
+	}
+	for _, key := range []string{"recent-processed", "old-verified"} {
+		if _, err := store.FindDocument(ctx, key); err != nil {
+			t.Fatalf("expected: %s kept, got: %v", key, err)
+		}
+	}
+	if _, err := store.FindBatch(ctx, oldBatchID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected: old batch deleted, got: %v", err)
+	}
+	if len(store.batches) != 1 {
+		t.Fatalf("expected: 1 batch kept, got: %d", len(store.batches))
+	}
+
+	archived := readArchive(t, archiveDir)
+	if len(archived) != 2 {
+		t.Fatalf("expected: 2 archived documents, got: %v", archived)
+	}
+	for _, doc := range archived {
+		if doc.Key != "old-processed" && doc.Key != "legacy-processed" {
+			t.Fatalf("expected: only the expired documents archived, got: %s", doc.Key)
+		}
+	}
+}
+
+// sharedKeyStore keeps the documents of several tenants in one list, like the collection of tenancy=field where
+// the tenants can use the same key.
+type sharedKeyStore struct {
+	*memoryStore
+	docs []MyDocument
+}
+
+func (s *sharedKeyStore) FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error) {
+	res := []MyDocument{}
+	for _, doc := range s.docs {
+		if query.match(&doc) && (query.Limit == 0 || len(res) < query.Limit) {
+			res = append(res, doc)
+		}
+	}
+	return res, nil
+}
+
+func (s *sharedKeyStore) DeleteDocuments(ctx context.Context, query DocumentQuery) (int64, error) {
+	kept := []MyDocument{}
+	for _, doc := range s.docs {
+		if !query.match(&doc) {
+			kept = append(kept, doc)
+		}
+	}
+	deleted := int64(len(s.docs) - len(kept))
+	s.docs = kept
+	return deleted, nil
+}
+
+// recordingArchive keeps the archived documents.
+type recordingArchive struct {
+	docs []MyDocument
+}
+
+func (a *recordingArchive) ArchiveDocuments(ctx context.Context, docs []MyDocument) error {
+	a.docs = append(a.docs, docs...)
+	return nil
+}
+
+func TestRetentionSharedKeys(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	store := &sharedKeyStore{memoryStore: newMemoryStore()}
+	for _, tenant := range []string{"acme", "globex"} {
+		id := primitive.NewObjectID()
+		store.docs = append(store.docs, MyDocument{ID: &id, TenantID: tenant, Key: "key1", State: STATE_PROCESSED, StateChangedAt: &old})
+	}
+	archive := &recordingArchive{}
+	worker := newRetentionWorker(store, archive, []retentionPolicy{{State: STATE_PROCESSED, MaxAge: 24 * time.Hour}}, 0, time.Hour)
+	worker.chunkSize = 1
+
+	// Each chunk only deletes the document it archived
+	if _, _, err := worker.applyChunk(context.Background(), DocumentQuery{State: STATE_PROCESSED, Limit: 1}); err != nil {
+		t.Fatalf("Could not apply retention: %v", err)
+	}
+	if len(store.docs) != 1 || store.docs[0].TenantID != "globex" || len(archive.docs) != 1 {
+		t.Fatalf("expected: only the document of acme archived and deleted, got: %+v kept and %+v archived", store.docs, archive.docs)
+	}
+	if err := worker.apply(context.Background(), time.Now()); err != nil {
+		t.Fatalf("Could not apply retention: %v", err)
+	}
+	if len(store.docs) != 0 || len(archive.docs) != 2 || archive.docs[1].TenantID != "globex" {
+		t.Fatalf("expected: both documents archived then deleted, got: %+v kept and %+v archived", store.docs, archive.docs)
+	}
+}
@@ -40,10 +40,11 @@ const (
 func TestMain(m *testing.M) {
 	ctx := context.Background()
 	image := "mongo:latest"
-	containerRequest := testcontainers.ContainerRequest{Image: image, ExposedPorts: []string{"27017/tcp"}, WaitingFor: wait.ForListeningPort("27017/tcp")}
-	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{ContainerRequest: containerRequest, Started: true})
+	container, err := startMongoContainer(ctx, image)
 	if err != nil {
-		log.Fatalf("Could not start test container (image: %s)", image)
+		// Tests using the in memory store can still run, the ones needing mongo will be skipped
+		log.Printf("Could not start test container (image: %s). Error: %v", image, err)
+		os.Exit(m.Run())
 	}
 	mongoContainer = container
 
@@ -80,6 +81,25 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+func startMongoContainer(ctx context.Context, image string) (container testcontainers.Container, err error) {
+	// testcontainers panics when there is no docker host available
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	containerRequest := testcontainers.ContainerRequest{Image: image, ExposedPorts: []string{"27017/tcp"}, WaitingFor: wait.ForListeningPort("27017/tcp")}
+	return testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{ContainerRequest: containerRequest, Started: true})
+}
+
+func requireMongo(t *testing.T) {
+	t.Helper()
+	if mongoContainer == nil {
+		t.Skip("Mongo test container is not available")
+	}
+}
+
 func setupMongo(ctx context.Context) string {
 	// Mongo info
 	host, _ := mongoContainer.Host(ctx)
@@ -100,7 +120,8 @@ func setupMongo(ctx context.Context) string {
 		log.Fatalf("Mongo is not restarted or ping not responding: %v", err)
 	}
 
-	serverCtx = serverContext{mongoClient: mongoClient, dbName: dbName, collectionIndex: make(map[string]bool)}
+	store := newMongoStore(mongoClient, dbName)
+	serverCtx = serverContext{documents: store, batches: store}
 	return uri
 }
 
@@ -132,10 +153,11 @@ func setupTestEnvironnement() {
 		log.Printf("Error trying to drop collection (%s). Error: %s\n", DocumentCollection, err.Error())
 	} else {
 		log.Printf("[Collection: %s] Was cleared\n", DocumentCollection)
-		// Needs to reset this map cause we cleared the db so the indexes should be created again
-		serverCtx.collectionIndex = map[string]bool{}
 	}
-	serverCtx.ensureIndex(collection, ctx)
+	// Needs a new store cause we cleared the db so the indexes should be created again
+	store := newMongoStore(mongoClient, testDB.Name())
+	serverCtx = serverContext{documents: store, batches: store}
+	store.ensureIndex(collection, ctx)
 	if listIndex {
 		listIndexes(DocumentCollection)
 	}
@@ -170,6 +192,7 @@ func countDocument(collectionName string) int64 {
 }
 
 func TestHttpServerRoot(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 	url := fmt.Sprintf("%s/", serverAddress)
 
@@ -194,6 +217,7 @@ func TestHttpServerRoot(t *testing.T) {
 }
 
 func TestHttpServerPostObject_OK(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 	url := fmt.Sprintf("%s/save", serverAddress)
 	doc := MyDocument{Name: "test1", Key: "key1"}
@@ -216,7 +240,7 @@ func TestHttpServerPostObject_OK(t *testing.T) {
 	}
 
 	t.Logf("Status: %d", resp.StatusCode)
-	t.Logf("Body: %s", body)
+	t.Logf("Body: %v", body)
 
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("expected: status 200, got: %d", resp.StatusCode)
@@ -228,6 +252,7 @@ func TestHttpServerPostObject_OK(t *testing.T) {
 }
 
 func TestHttpServerPostObject_DuplicateKey(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 	url := fmt.Sprintf("%s/save", serverAddress)
 	doc := MyDocument{Name: "test1", Key: "key1"}
@@ -269,6 +294,7 @@ func TestHttpServerPostObject_DuplicateKey(t *testing.T) {
 }
 
 func TestHttpServerPostObject_Loop(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 	url := fmt.Sprintf("%s/save", serverAddress)
 	size := 10_000
@@ -330,6 +356,7 @@ func putRequest(t *testing.T, key string, state string) *http.Response {
 }
 
 func TestHttpServerUpdateToVerified(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 
 	// Setup DB
@@ -370,6 +397,7 @@ func TestHttpServerUpdateToVerified(t *testing.T) {
 }
 
 func TestHttpServerHealthCheck_OK(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 	url := fmt.Sprintf("%s/health", serverAddress)
 
@@ -395,6 +423,7 @@ func TestHttpServerHealthCheck_OK(t *testing.T) {
 }
 
 func TestHttpServerHealthCheck_KO(t *testing.T) {
+	requireMongo(t)
 	setupTestEnvironnement()
 	url := fmt.Sprintf("%s/health", serverAddress)
 
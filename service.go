@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The operations below are shared by the HTTP handlers and the gRPC service.
+
+// saveDocument inserts doc in state INIT, generating its id if needed. With the spool, the document is spooled when
+// the storage is unavailable: spooled is then true and it is inserted later.
+func (s *serverContext) saveDocument(ctx context.Context, doc *MyDocument) (spooled bool, err error) {
+	if err := s.validateDocument(doc.Payload, doc.Labels); err != nil {
+		return false, err
+	}
+	if doc.ID == nil {
+		id := primitive.NewObjectID()
+		doc.ID = &id
+	}
+	doc.State = STATE_INIT
+	doc.Version = 1
+	createdAt := now()
+	doc.CreatedAt, doc.UpdatedAt, doc.StateChangedAt = &createdAt, &createdAt, &createdAt
+	doc.CreatedBy, doc.UpdatedBy = actorFrom(ctx), actorFrom(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, s.runtime().writeTimeout)
+	defer cancel()
+
+	// The spooled documents are replayed in order, the next ones wait behind them
+	if s.spool != nil && s.spool.Depth() > 0 {
+		return s.spoolDocument(ctx, doc)
+	}
+	insert := s.documents.InsertDocument
+	if s.saves != nil {
+		insert = s.saves.InsertDocument
+	}
+	if err := insert(ctx, doc); err != nil {
+		if s.spool != nil && (isStoreFailure(err) || errors.Is(err, ErrCircuitOpen)) {
+			return s.spoolDocument(ctx, doc)
+		}
+		myLogger.Log.Error().Msgf("Could not insert document :/")
+		return false, err
+	}
+	myLogger.Log.Debug().Msg("Document was inserted")
+	s.emit(ctx, newStateChangeEvent(doc.Key, doc.State))
+	return false, nil
+}
+
+func (s *serverContext) spoolDocument(ctx context.Context, doc *MyDocument) (bool, error) {
+	if err := s.spool.Append(tenantFrom(ctx), doc); err != nil {
+		myLogger.Log.Error().Msgf("Could not spool document: %s", err.Error())
+		return false, fmt.Errorf("storage unavailable and could not spool the document: %w", err)
+	}
+	myLogger.Log.Debug().Msg("Document was spooled")
+	return true, nil
+}
+
+// findDocument returns ErrNotFound if there is no document with this key.
+func (s *serverContext) findDocument(ctx context.Context, key string) (*MyDocument, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.runtime().readTimeout)
+	defer cancel()
+	return s.documents.FindDocument(ctx, key)
+}
+
+// updateState moves the document from INIT to updateState. It returns ErrInvalidTransition if the state machine doesn't
+// allow this move, and ErrVersionMismatch if version is not 0 and the document is not in this version anymore.
+func (s *serverContext) updateState(ctx context.Context, key string, updateState string, version int64) (*UpdateResult, error) {
+	if err := s.stateMachine().validate(STATE_INIT, StateChange{State: updateState}); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.runtime().writeTimeout)
+	defer cancel()
+
+	res, err := s.documents.UpdateState(ctx, key, STATE_INIT, version, StateChange{State: updateState, UpdatedBy: actorFrom(ctx)})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 && version != 0 {
+		// Not matched because of its state (answered as before) or because of its version
+		doc, err := s.documents.FindDocument(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s doesn't exist", ErrVersionMismatch, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc.Version != version {
+			return nil, fmt.Errorf("%w: expected version %d, got: %d", ErrVersionMismatch, version, doc.Version)
+		}
+	}
+	if res.ModifiedCount > 0 {
+		s.emit(ctx, newStateChangeEvent(key, updateState))
+	}
+	return res, nil
+}
+
+// changeState moves the document to req.State if the state machine allows it and returns the updated document.
+// It returns ErrStateConflict if the document is not in req.ExpectedCurrentState or if its state changed meanwhile,
+// and ErrVersionMismatch if version is not 0 and the document is in another version.
+func (s *serverContext) changeState(ctx context.Context, key string, req StateChangeRequest, version int64) (*MyDocument, error) {
+	change := StateChange{State: strings.ToUpper(strings.TrimSpace(req.State)), Reason: req.Reason, Comment: req.Comment, UpdatedBy: actorFrom(ctx)}
+	if change.State == "" {
+		return nil, fmt.Errorf("%w: state can't be empty", ErrInvalidStateChange)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.runtime().writeTimeout)
+	defer cancel()
+
+	doc, err := s.documents.FindDocument(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && doc.Version != version {
+		return nil, fmt.Errorf("%w: expected version %d, got: %d", ErrVersionMismatch, version, doc.Version)
+	}
+	if expected := strings.ToUpper(req.ExpectedCurrentState); expected != "" && expected != doc.State {
+		return nil, fmt.Errorf("%w: expected current state %s, got: %s", ErrStateConflict, expected, doc.State)
+	}
+	if err := s.stateMachine().validate(doc.State, change); err != nil {
+		return nil, err
+	}
+
+	res, err := s.documents.UpdateState(ctx, key, doc.State, doc.Version, change)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		if version != 0 {
+			return nil, fmt.Errorf("%w: %s changed during the update", ErrVersionMismatch, key)
+		}
+		return nil, fmt.Errorf("%w: %s changed during the update", ErrStateConflict, key)
+	}
+	myLogger.Log.Debug().Msgf("Document %s moved from %s to %s", key, doc.State, change.State)
+
+	doc.State, doc.Reason, doc.Comment = change.State, change.Reason, change.Comment
+	if res.ModifiedCount > 0 {
+		// Close to the time the store saved (MongoDB uses its own clock)
+		updatedAt := now()
+		doc.UpdatedAt, doc.StateChangedAt, doc.UpdatedBy = &updatedAt, &updatedAt, change.UpdatedBy
+		doc.Version++
+		s.emit(ctx, newStateChangeEvent(key, change.State))
+	}
+	return doc, nil
+}
+
+func (s *serverContext) stateMachine() stateMachine {
+	return s.runtime().states
+}
+
+// saveBatch inserts the batch, generating its id if needed.
+func (s *serverContext) saveBatch(ctx context.Context, batch *MyDocumentList) error {
+	if batch.ID == nil {
+		id := primitive.NewObjectID()
+		batch.ID = &id
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.runtime().writeTimeout)
+	defer cancel()
+
+	if err := s.batches.InsertBatch(ctx, batch); err != nil {
+		myLogger.Log.Error().Msg("Could not insert document :/")
+		return err
+	}
+	myLogger.Log.Debug().Msgf("Document batch was inserted. Id: %s", batch.ID.Hex())
+	return nil
+}
+
+// processBatch sets the documents of the batch to PROCESSED, only from the states the state machine allows. It returns
+// ErrNotFound if the batch doesn't exist.
+func (s *serverContext) processBatch(ctx context.Context, batchId primitive.ObjectID) (*UpdateResult, []string, error) {
+	ctxRead, cancelRead := context.WithTimeout(ctx, s.runtime().readTimeout)
+	defer cancelRead()
+
+	batchDocument, err := s.batches.FindBatch(ctxRead, batchId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctxProcess, cancelProcess := context.WithTimeout(ctx, s.runtime().bulkTimeout)
+	defer cancelProcess()
+
+	keys := make([]string, 0, len(batchDocument.ToProcess))
+	for _, doc := range batchDocument.ToProcess {
+		keys = append(keys, doc.Key)
+	}
+
+	res, processedKeys, err := s.documents.ProcessDocuments(ctxProcess, keys, s.stateMachine().sources(STATE_PROCESSED), actorFrom(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, processedKey := range processedKeys {
+		s.emit(ctx, newStateChangeEvent(processedKey, STATE_PROCESSED))
+	}
+	s.webhooks.Dispatch(tenantFrom(ctx), EVENT_BATCH_COMPLETED, BatchCompletedEvent{
+		ID:            newEventId(),
+		Type:          EVENT_BATCH_COMPLETED,
+		BatchID:       batchId.Hex(),
+		MatchedCount:  res.MatchedCount,
+		ModifiedCount: res.ModifiedCount,
+		Time:          time.Now().UTC(),
+	})
+	return res, processedKeys, nil
+}
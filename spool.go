@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mongo-http-audit-service/src/myLogger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spooledDocument is a saved document waiting in the spool, with the tenant of its request.
+type spooledDocument struct {
+	Tenant   string      `json:"tenant,omitempty"`
+	Document *MyDocument `json:"document"`
+}
+
+// spoolConflict is a spooled document that the storage refused on replay.
+type spoolConflict struct {
+	Time     time.Time   `json:"time"`
+	Tenant   string      `json:"tenant,omitempty"`
+	Error    string      `json:"error"`
+	Document *MyDocument `json:"document"`
+}
+
+// ErrSpoolFull is returned by Append once the documents waiting in the spool reach its max size.
+var ErrSpoolFull = errors.New("spool full")
+
+// documentSpool keeps the saves accepted while the storage is unavailable in an append-only file, until they are
+// replayed. The documents before the read offset, saved in a file next to the spool, are already replayed: the file is
+// emptied once everything is replayed, or compacted when the replayed part is larger than the rest.
+type documentSpool struct {
+	path          string
+	offsetPath    string
+	conflictsPath string
+	// maxSize is the max size in bytes of the documents waiting, 0 for no limit
+	maxSize int64
+
+	mu         sync.Mutex
+	file       *os.File
+	readOffset int64
+	size       int64
+	depth      int
+	conflicts  int64
+}
+
+// openSpool loads the state of the spool left by the previous run.
+func openSpool(path string, conflictsPath string, maxSize int64) (*documentSpool, error) {
+	s := &documentSpool{path: path, offsetPath: path + ".offset", conflictsPath: conflictsPath, maxSize: maxSize}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if s.depth > 0 {
+		myLogger.For("spool").Info().Msgf("[Spool] %d documents to replay from %s", s.depth, path)
+	}
+	return s, nil
+}
+
+// load reads the read offset and counts the documents after it.
+func (s *documentSpool) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+
+	content, err := os.ReadFile(s.offsetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		if s.readOffset, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return fmt.Errorf("corrupted offset in %s: %w", s.offsetPath, err)
+		}
+	}
+	if s.readOffset > s.size {
+		// The offset is written before the spool is emptied or compacted, replaying again is harmless
+		myLogger.For("spool").Warn().Msgf("[Spool] Offset %d after the end of %s, replaying it from the start", s.readOffset, s.path)
+		s.readOffset = 0
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(s.file, s.readOffset, s.size-s.readOffset))
+	end := s.readOffset
+	line := 0
+	for {
+		bytes, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(bytes) == 0 {
+			break
+		}
+		line++
+		var entry spooledDocument
+		if err != nil || json.Unmarshal(bytes, &entry) != nil || entry.Document == nil {
+			// Only the last line can be incomplete (crash while writing it), it was never acknowledged
+			if _, err := reader.Peek(1); err == io.EOF {
+				myLogger.For("spool").Warn().Msgf("[Spool] Dropping incomplete last document (line %d) of %s", line, s.path)
+				if err := s.file.Truncate(end); err != nil {
+					return err
+				}
+				s.size = end
+				break
+			}
+			return fmt.Errorf("corrupted document line %d of %s", line, s.path)
+		}
+		end += int64(len(bytes))
+		s.depth++
+	}
+	return nil
+}
+
+// Append writes the document to the spool, it is on disk when Append returns. It returns ErrSpoolFull if the documents
+// waiting would take more than the max size.
+func (s *documentSpool) Append(tenant string, doc *MyDocument) error {
+	line, err := json.Marshal(spooledDocument{Tenant: tenant, Document: doc})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if s.maxSize > 0 && s.size-s.readOffset+int64(len(line)) > s.maxSize {
+		return fmt.Errorf("%w: %d documents waiting", ErrSpoolFull, s.depth)
+	}
+	if _, err := s.file.Write(line); err != nil {
+		// Don't leave half a document in the spool, the next ones would be unreadable
+		s.file.Truncate(s.size)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(line))
+	s.depth++
+	return nil
+}
+
+// Depth returns the number of documents waiting to be replayed.
+func (s *documentSpool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// peek reads the first documents to replay, at most limit.
+func (s *documentSpool) peek(limit int) ([]spooledDocument, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil, os.ErrClosed
+	}
+
+	entries := make([]spooledDocument, 0, min(limit, s.depth))
+	decoder := json.NewDecoder(io.NewSectionReader(s.file, s.readOffset, s.size-s.readOffset))
+	for len(entries) < cap(entries) {
+		var entry spooledDocument
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// remove drops the first count documents by moving the read offset after them.
+func (s *documentSpool) remove(count int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+
+	offset := s.readOffset
+	reader := bufio.NewReader(io.NewSectionReader(s.file, s.readOffset, s.size-s.readOffset))
+	for range count {
+		bytes, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		offset += int64(len(bytes))
+	}
+	if err := s.writeOffset(offset); err != nil {
+		return err
+	}
+	s.readOffset = offset
+	s.depth -= count
+
+	switch {
+	case s.depth == 0:
+		return s.reset()
+	case s.readOffset > s.size-s.readOffset:
+		return s.compact()
+	}
+	return nil
+}
+
+// writeOffset replaces the offset file, it is on disk when writeOffset returns.
+func (s *documentSpool) writeOffset(offset int64) error {
+	tmpPath := s.offsetPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.offsetPath)
+}
+
+// reset empties the spool once every document is replayed.
+func (s *documentSpool) reset() error {
+	if err := s.writeOffset(0); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	s.readOffset, s.size = 0, 0
+	return nil
+}
+
+// compact copies the documents left in a new spool file. The offset is written first: a crash in between only replays
+// documents again.
+func (s *documentSpool) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if _, err := io.Copy(tmp, io.NewSectionReader(s.file, s.readOffset, s.size-s.readOffset)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := s.writeOffset(0); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.size -= s.readOffset
+	s.readOffset = 0
+	return nil
+}
+
+// conflict appends a document refused on replay to the conflicts log.
+func (s *documentSpool) conflict(entry spooledDocument, cause error) error {
+	line, err := json.Marshal(spoolConflict{Time: now(), Tenant: entry.Tenant, Error: cause.Error(), Document: entry.Document})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.conflictsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.conflicts++
+	s.mu.Unlock()
+	return nil
+}
+
+// spoolStats is the state of the spool in the health details and the metrics.
+type spoolStats struct {
+	Depth     int   `json:"depth"`
+	Conflicts int64 `json:"conflicts"`
+}
+
+func (s *documentSpool) stats() spoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return spoolStats{Depth: s.depth, Conflicts: s.conflicts}
+}
+
+func (s *documentSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// spoolReplayer inserts the spooled documents in order once the storage is back, interval after each failure.
+type spoolReplayer struct {
+	spool     *documentSpool
+	documents DocumentStore
+	// emit publishes the event of each replayed document
+	emit      func(ctx context.Context, event StateChangeEvent)
+	interval  time.Duration
+	timeout   time.Duration
+	chunkSize int
+}
+
+func newSpoolReplayer(spool *documentSpool, documents DocumentStore, emit func(ctx context.Context, event StateChangeEvent), interval time.Duration, timeout time.Duration) *spoolReplayer {
+	return &spoolReplayer{spool: spool, documents: documents, emit: emit, interval: interval, timeout: timeout, chunkSize: 100}
+}
+
+// Run replays the spool every interval until ctx is done.
+func (r *spoolReplayer) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if r.spool.Depth() > 0 {
+			replayed, err := r.replay(ctx)
+			if replayed > 0 {
+				myLogger.For("spool").Info().Msgf("[Spool] %d documents replayed, %d left", replayed, r.spool.Depth())
+			}
+			if err != nil {
+				myLogger.For("spool").Warn().Msgf("[Spool] Replay stopped, retrying in %s: %s", r.interval, err.Error())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replay inserts the spooled documents until the spool is empty or the storage fails.
+func (r *spoolReplayer) replay(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		entries, err := r.spool.peek(r.chunkSize)
+		if err != nil || len(entries) == 0 {
+			return total, err
+		}
+		done := 0
+		var replayErr error
+		for _, entry := range entries {
+			if replayErr = r.replayOne(ctx, entry); replayErr != nil {
+				break
+			}
+			done++
+		}
+		if done > 0 {
+			if err := r.spool.remove(done); err != nil {
+				return total, err
+			}
+			total += done
+		}
+		if replayErr != nil {
+			return total, replayErr
+		}
+	}
+}
+
+// replayOne inserts one document. It returns an error only when the storage failed, the documents refused by the
+// storage go to the conflicts log.
+func (r *spoolReplayer) replayOne(ctx context.Context, entry spooledDocument) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	if entry.Tenant != "" {
+		ctx = withTenant(ctx, entry.Tenant)
+	}
+
+	doc := *entry.Document
+	err := r.documents.InsertDocument(ctx, &doc)
+	if err == nil {
+		r.emit(ctx, newStateChangeEvent(doc.Key, doc.State))
+		return nil
+	}
+	if isStoreFailure(err) || errors.Is(err, ErrCircuitOpen) {
+		return err
+	}
+	if errors.Is(err, ErrDuplicateKey) {
+		// Already inserted by a replay stopped before the read offset was saved
+		if existing, findErr := r.documents.FindDocument(ctx, doc.Key); findErr == nil && existing.ID != nil && doc.ID != nil && *existing.ID == *doc.ID {
+			return nil
+		}
+	}
+
+	myLogger.For("spool").Warn().Msgf("[Spool] Document %s refused on replay, see %s: %s", doc.Key, r.spool.conflictsPath, err.Error())
+	return r.spool.conflict(entry, err)
+}
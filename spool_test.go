@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openSpool(filepath.Join(dir, "spool.ndjson"), filepath.Join(dir, "conflicts.ndjson"), 0)
+	if err != nil {
+		t.Fatalf("Could not open spool: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := spool.Append("tenant", &MyDocument{Name: "name", Key: key}); err != nil {
+			t.Fatalf("Could not append to spool: %v", err)
+		}
+	}
+	if err := spool.remove(1); err != nil {
+		t.Fatalf("Could not remove from spool: %v", err)
+	}
+	spool.Close()
+	// Crash while writing a document
+	file, _ := os.OpenFile(filepath.Join(dir, "spool.ndjson"), os.O_WRONLY|os.O_APPEND, 0o644)
+	file.WriteString(`{"document":{"na`)
+	file.Close()
+
+	spool, err = openSpool(filepath.Join(dir, "spool.ndjson"), filepath.Join(dir, "conflicts.ndjson"), 0)
+	if err != nil {
+		t.Fatalf("Could not reopen spool: %v", err)
+	}
+	defer spool.Close()
+	entries, err := spool.peek(10)
+	if err != nil || len(entries) != 2 || entries[0].Document.Key != "b" || entries[1].Document.Key != "c" || entries[0].Tenant != "tenant" {
+		t.Fatalf("expected: b and c of tenant, got: %+v", entries)
+	}
+	if err := spool.Append("", &MyDocument{Name: "name", Key: "d"}); err != nil {
+		t.Fatalf("Could not append to spool: %v", err)
+	}
+	if entries, err := spool.peek(10); err != nil || len(entries) != 3 || entries[2].Document.Key != "d" {
+		t.Fatalf("expected: b, c and d, got: %+v (err: %v)", entries, err)
+	}
+}
+
+func TestSpoolOffsetAndMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "spool.ndjson")
+	line, _ := json.Marshal(spooledDocument{Document: &MyDocument{Name: "name", Key: "a"}})
+	spool, err := openSpool(path, filepath.Join(dir, "conflicts.ndjson"), int64(3*(len(line)+1)))
+	if err != nil {
+		t.Fatalf("Could not open spool: %v", err)
+	}
+	defer spool.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := spool.Append("", &MyDocument{Name: "name", Key: key}); err != nil {
+			t.Fatalf("Could not append to spool: %v", err)
+		}
+	}
+	if err := spool.Append("", &MyDocument{Name: "name", Key: "d"}); !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("expected: %v, got: %v", ErrSpoolFull, err)
+	}
+
+	// Only the offset moves, the spool is compacted once the replayed part is larger than the rest
+	if err := spool.remove(1); err != nil {
+		t.Fatalf("Could not remove from spool: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(3*(len(line)+1)) {
+		t.Fatalf("expected: the spool unchanged, got: %d bytes", info.Size())
+	}
+	if err := spool.Append("", &MyDocument{Name: "name", Key: "d"}); err != nil {
+		t.Fatalf("Could not append to spool: %v", err)
+	}
+	if err := spool.remove(2); err != nil {
+		t.Fatalf("Could not remove from spool: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(line)+1) || spool.Depth() != 1 {
+		t.Fatalf("expected: d alone in the spool, got: %d bytes and %d documents", info.Size(), spool.Depth())
+	}
+	if entries, err := spool.peek(10); err != nil || len(entries) != 1 || entries[0].Document.Key != "d" {
+		t.Fatalf("expected: d, got: %+v (err: %v)", entries, err)
+	}
+
+	if err := spool.remove(1); err != nil {
+		t.Fatalf("Could not remove from spool: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 || spool.Depth() != 0 {
+		t.Fatalf("expected: an empty spool, got: %d bytes and %d documents", info.Size(), spool.Depth())
+	}
+}
+
+func readConflicts(t *testing.T, path string) []spoolConflict {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open conflicts: %v", err)
+	}
+	defer file.Close()
+	conflicts := []spoolConflict{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var conflict spoolConflict
+		if err := json.Unmarshal(scanner.Bytes(), &conflict); err != nil {
+			t.Fatalf("Could not deserialized conflict: %v", err)
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts
+}
+
+func TestSpoolSaveAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openSpool(filepath.Join(dir, "spool.ndjson"), filepath.Join(dir, "conflicts.ndjson"), 0)
+	if err != nil {
+		t.Fatalf("Could not open spool: %v", err)
+	}
+	defer spool.Close()
+
+	unavailable := &unavailableStore{memoryStore: newMemoryStore()}
+	ctx := &serverContext{documents: unavailable, batches: unavailable, events: newEventBroker(10), spool: spool}
+	server := httptest.NewServer(ctx.MainServer(true))
+	defer server.Close()
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/save", MyDocument{Name: "name", Key: "first"})
+	expectStatus(t, resp, body, http.StatusAccepted)
+	// Once a document is spooled, the next ones wait behind it
+	store := newMemoryStore()
+	ctx.documents, ctx.batches = store, store
+	resp, body = doRequest(t, http.MethodPost, server.URL+"/save", MyDocument{Name: "name", Key: "second"})
+	expectStatus(t, resp, body, http.StatusAccepted)
+	if unavailable.calls != 1 || spool.Depth() != 2 {
+		t.Fatalf("expected: 2 documents spooled after 1 insert, got: %d after %d", spool.Depth(), unavailable.calls)
+	}
+
+	// second is already saved by someone else, first was replayed before a crash
+	if err := store.InsertDocument(context.Background(), &MyDocument{Name: "other", Key: "second"}); err != nil {
+		t.Fatalf("Could not insert document: %v", err)
+	}
+	entries, err := spool.peek(1)
+	if err != nil {
+		t.Fatalf("Could not read spool: %v", err)
+	}
+	first := *entries[0].Document
+	if err := store.InsertDocument(context.Background(), &first); err != nil {
+		t.Fatalf("Could not insert document: %v", err)
+	}
+	if err := spool.Append("", &MyDocument{Name: "name", Key: "third", State: STATE_INIT}); err != nil {
+		t.Fatalf("Could not append to spool: %v", err)
+	}
+
+	replayer := newSpoolReplayer(spool, store, ctx.emit, time.Second, time.Second)
+	replayed, err := replayer.replay(context.Background())
+	if err != nil || replayed != 3 || spool.Depth() != 0 {
+		t.Fatalf("expected: 3 documents replayed, got: %d, %d left (err: %v)", replayed, spool.Depth(), err)
+	}
+	if doc, err := store.FindDocument(context.Background(), "third"); err != nil || doc.State != STATE_INIT {
+		t.Fatalf("expected: third saved, got: %v (err: %v)", doc, err)
+	}
+
+	conflicts := readConflicts(t, filepath.Join(dir, "conflicts.ndjson"))
+	if len(conflicts) != 1 || conflicts[0].Document.Key != "second" || spool.stats().Conflicts != 1 {
+		t.Fatalf("expected: second in the conflicts, got: %+v", conflicts)
+	}
+}
+
+func TestSpoolReplayStopsOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openSpool(filepath.Join(dir, "spool.ndjson"), filepath.Join(dir, "conflicts.ndjson"), 0)
+	if err != nil {
+		t.Fatalf("Could not open spool: %v", err)
+	}
+	defer spool.Close()
+	if err := spool.Append("", &MyDocument{Name: "name", Key: "key"}); err != nil {
+		t.Fatalf("Could not append to spool: %v", err)
+	}
+
+	store := &unavailableStore{memoryStore: newMemoryStore()}
+	replayer := newSpoolReplayer(spool, store, func(ctx context.Context, event StateChangeEvent) {}, time.Second, time.Second)
+	if replayed, err := replayer.replay(context.Background()); err == nil || replayed != 0 || spool.Depth() != 1 {
+		t.Fatalf("expected: nothing replayed with an error, got: %d replayed, %d left (err: %v)", replayed, spool.Depth(), err)
+	}
+}
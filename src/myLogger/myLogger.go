@@ -1,47 +1,209 @@
 package myLogger
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	OUTPUT_STDOUT = "stdout"
+	OUTPUT_STDERR = "stderr"
+	OUTPUT_FILE   = "file"
+	OUTPUT_SYSLOG = "syslog"
+
+	// FORMAT_GCP is understood by Cloud Logging, FORMAT_ECS follows the Elastic Common Schema and FORMAT_PLAIN keeps
+	// the names of zerolog
+	FORMAT_GCP   = "gcp"
+	FORMAT_ECS   = "ecs"
+	FORMAT_PLAIN = "plain"
+)
+
+var (
+	Outputs = []string{OUTPUT_STDOUT, OUTPUT_STDERR, OUTPUT_FILE, OUTPUT_SYSLOG}
+	Formats = []string{FORMAT_GCP, FORMAT_ECS, FORMAT_PLAIN}
 )
 
 var Log zerolog.Logger
 
+// Options of Init. The zero value logs in the GCP format to stderr, or to the console on stdout with Dev.
+type Options struct {
+	Dev   bool
+	Level string
+	// Levels are the levels of the subsystems of For, the others use Level
+	Levels map[string]string
+	// Outputs are OUTPUT_STDOUT, OUTPUT_STDERR, OUTPUT_FILE or OUTPUT_SYSLOG, stderr if empty. With Dev, stdout is the
+	// console.
+	Outputs []string
+	Format  string
+
+	FilePath string
+	// FileMaxSize is the size in bytes that rotates the file, 0 for no rotation
+	FileMaxSize int64
+	// FileMaxAge and FileMaxBackups limit the rotated files kept, 0 for no limit
+	FileMaxAge     time.Duration
+	FileMaxBackups int
+
+	// SyslogAddress is the local socket of syslog, the default one of the system if empty
+	SyslogAddress string
+	SyslogTag     string
+
+	// SampleEvery keeps one in SampleEvery lines of Sampled, every line if 0 or 1
+	SampleEvery uint32
+}
+
+var (
+	// loggersMu serializes the writers of loggers, the readers only load it
+	loggersMu sync.Mutex
+	loggers   atomic.Pointer[loggerSet]
+	// closers are the outputs to close on the next Init
+	closers []io.Closer
+
+	levelsMu sync.Mutex
+	levels   atomic.Pointer[levelSettings]
+)
+
+// loggerSet is replaced as a whole when a logger is added, so For and Sampled don't lock on the hot paths.
+type loggerSet struct {
+	// base is Log without the level of the logs
+	base       zerolog.Logger
+	subsystems map[string]*zerolog.Logger
+	sampled    *zerolog.Logger
+}
+
+// levelSettings are the levels set by SetLevels, read by every line logged.
+type levelSettings struct {
+	defaultLevel    zerolog.Level
+	subsystemLevels map[string]zerolog.Level
+}
+
 func InitLogging(isDev bool, levelLog string) {
+	// Can't fail without file or syslog output
+	Init(Options{Dev: isDev, Level: levelLog})
+}
+
+// Init replaces Log by a logger writing to the outputs of opts.
+func Init(opts Options) error {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	zerolog.SetGlobalLevel(getLogLevel(levelLog))
+	setFormat(opts.Format)
+	SetLevels(opts.Level, opts.Levels)
 
-	zerolog.LevelFieldName = "severity"
-	zerolog.LevelFieldMarshalFunc = func(l zerolog.Level) string {
-		switch l {
-		case zerolog.DebugLevel:
-			return "DEBUG"
-		case zerolog.InfoLevel:
-			return "INFO"
-		case zerolog.WarnLevel:
-			return "WARNING"
-		case zerolog.ErrorLevel:
-			return "ERROR"
-		case zerolog.FatalLevel:
-			return "CRITICAL"
-		case zerolog.PanicLevel:
-			return "ALERT"
+	outputs := opts.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{OUTPUT_STDERR}
+		if opts.Dev {
+			outputs = []string{OUTPUT_STDOUT}
+		}
+	}
+	writers := []io.Writer{}
+	opened := []io.Closer{}
+	for _, output := range outputs {
+		switch output {
+		case OUTPUT_STDOUT:
+			if opts.Dev {
+				writers = append(writers, zerolog.ConsoleWriter{Out: redactingWriter{out: os.Stdout}, TimeFormat: time.RFC3339})
+			} else {
+				writers = append(writers, redactingWriter{out: os.Stdout})
+			}
+		case OUTPUT_STDERR:
+			writers = append(writers, redactingWriter{out: os.Stderr})
+		case OUTPUT_FILE:
+			file, err := openRotatingFile(opts.FilePath, opts.FileMaxSize, opts.FileMaxAge, opts.FileMaxBackups)
+			if err != nil {
+				closeAll(opened)
+				return fmt.Errorf("log file %s: %w", opts.FilePath, err)
+			}
+			writers = append(writers, redactingWriter{out: file})
+			opened = append(opened, file)
+		case OUTPUT_SYSLOG:
+			writer, err := dialSyslog(opts.SyslogAddress, opts.SyslogTag)
+			if err != nil {
+				closeAll(opened)
+				return fmt.Errorf("syslog %s: %w", opts.SyslogAddress, err)
+			}
+			writers = append(writers, redactingWriter{out: writer})
+			opened = append(opened, writer)
 		default:
-			return "DEFAULT"
+			closeAll(opened)
+			return fmt.Errorf("unknown log output: %s (expected: %s)", output, strings.Join(Outputs, ", "))
 		}
 	}
 
-	if isDev {
-		output := zerolog.ConsoleWriter{
-			Out:        os.Stdout,
-			TimeFormat: time.RFC3339,
+	var output io.Writer = writers[0]
+	if len(writers) > 1 {
+		output = zerolog.MultiLevelWriter(writers...)
+	}
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+	previous := closers
+	set := &loggerSet{base: zerolog.New(output).With().Timestamp().Caller().Logger(), subsystems: map[string]*zerolog.Logger{}}
+	Log = set.base.Hook(levelHook{})
+	set.sampled = &Log
+	if opts.SampleEvery > 1 {
+		logger := Log.Sample(&zerolog.BasicSampler{N: opts.SampleEvery})
+		set.sampled = &logger
+	}
+	loggers.Store(set)
+	closers = opened
+	// The global logger is redacted too
+	log.Logger = Log
+	closeAll(previous)
+	return nil
+}
+
+func closeAll(outputs []io.Closer) {
+	for _, output := range outputs {
+		output.Close()
+	}
+}
+
+// setFormat sets the names of the fields and levels of the format, FORMAT_GCP if unknown.
+func setFormat(format string) {
+	zerolog.TimestampFieldName = "time"
+	zerolog.MessageFieldName = "message"
+	zerolog.ErrorFieldName = "error"
+	zerolog.CallerFieldName = "caller"
+	zerolog.LevelFieldName = "level"
+	zerolog.LevelFieldMarshalFunc = func(l zerolog.Level) string {
+		return l.String()
+	}
+
+	switch format {
+	case FORMAT_PLAIN:
+		zerolog.TimeFieldFormat = time.RFC3339
+	case FORMAT_ECS:
+		zerolog.TimeFieldFormat = time.RFC3339Nano
+		zerolog.TimestampFieldName = "@timestamp"
+		zerolog.LevelFieldName = "log.level"
+		zerolog.CallerFieldName = "log.origin.file.name"
+		zerolog.ErrorFieldName = "error.message"
+	default:
+		zerolog.LevelFieldName = "severity"
+		zerolog.LevelFieldMarshalFunc = func(l zerolog.Level) string {
+			switch l {
+			case zerolog.DebugLevel:
+				return "DEBUG"
+			case zerolog.InfoLevel:
+				return "INFO"
+			case zerolog.WarnLevel:
+				return "WARNING"
+			case zerolog.ErrorLevel:
+				return "ERROR"
+			case zerolog.FatalLevel:
+				return "CRITICAL"
+			case zerolog.PanicLevel:
+				return "ALERT"
+			default:
+				return "DEFAULT"
+			}
 		}
-		Log = zerolog.New(output).With().Timestamp().Caller().Logger()
-	} else {
-		Log = zerolog.New(os.Stderr).With().Timestamp().Caller().Logger()
 	}
 }
 
@@ -61,3 +223,86 @@ func getLogLevel(level string) zerolog.Level {
 		return zerolog.InfoLevel
 	}
 }
+
+// SetLevel changes the level of the logs without restart.
+func SetLevel(levelLog string) {
+	subsystems := map[string]string{}
+	if current := levels.Load(); current != nil {
+		for subsystem, level := range current.subsystemLevels {
+			subsystems[subsystem] = level.String()
+		}
+	}
+	SetLevels(levelLog, subsystems)
+}
+
+// SetLevels changes the level of the logs and the ones of the subsystems without restart.
+func SetLevels(levelLog string, subsystems map[string]string) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	settings := &levelSettings{defaultLevel: getLogLevel(levelLog), subsystemLevels: map[string]zerolog.Level{}}
+	// The global level skips the lines that no logger writes before they are built
+	lowest := settings.defaultLevel
+	for subsystem, level := range subsystems {
+		settings.subsystemLevels[subsystem] = getLogLevel(level)
+		lowest = min(lowest, settings.subsystemLevels[subsystem])
+	}
+	levels.Store(settings)
+	zerolog.SetGlobalLevel(lowest)
+}
+
+func levelOf(subsystem string) zerolog.Level {
+	settings := levels.Load()
+	if settings == nil {
+		return zerolog.InfoLevel
+	}
+	if level, ok := settings.subsystemLevels[subsystem]; ok {
+		return level
+	}
+	return settings.defaultLevel
+}
+
+// levelHook drops the lines below the level of the subsystem of the logger.
+type levelHook struct {
+	subsystem string
+}
+
+func (h levelHook) Run(e *zerolog.Event, level zerolog.Level, message string) {
+	if level != zerolog.NoLevel && level < levelOf(h.subsystem) {
+		e.Discard()
+	}
+}
+
+// For returns the logger of a subsystem: its lines have a subsystem field and its level can differ from the others.
+func For(subsystem string) *zerolog.Logger {
+	if set := loggers.Load(); set != nil {
+		if logger, ok := set.subsystems[subsystem]; ok {
+			return logger
+		}
+	}
+
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+	current := loggers.Load()
+	if current == nil {
+		current = &loggerSet{}
+	}
+	if logger, ok := current.subsystems[subsystem]; ok {
+		return logger
+	}
+	logger := current.base.With().Str("subsystem", subsystem).Logger().Hook(levelHook{subsystem: subsystem})
+	set := &loggerSet{base: current.base, subsystems: make(map[string]*zerolog.Logger, len(current.subsystems)+1), sampled: current.sampled}
+	for name, other := range current.subsystems {
+		set.subsystems[name] = other
+	}
+	set.subsystems[subsystem] = &logger
+	loggers.Store(set)
+	return &logger
+}
+
+// Sampled returns the logger of the hot paths, keeping one in Options.SampleEvery lines.
+func Sampled() *zerolog.Logger {
+	if set := loggers.Load(); set != nil && set.sampled != nil {
+		return set.sampled
+	}
+	return &Log
+}
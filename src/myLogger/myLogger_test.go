@@ -0,0 +1,139 @@
+package myLogger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readLines returns the JSON lines written to the log file.
+func readLines(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open log file: %v", err)
+	}
+	defer file.Close()
+	lines := []map[string]any{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := map[string]any{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Could not deserialized line %s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func initFile(t *testing.T, opts Options) string {
+	t.Helper()
+	opts.Outputs = []string{OUTPUT_FILE}
+	opts.FilePath = filepath.Join(t.TempDir(), "audit.log")
+	if err := Init(opts); err != nil {
+		t.Fatalf("Could not init the logs: %v", err)
+	}
+	t.Cleanup(func() { InitLogging(false, "INFO") })
+	return opts.FilePath
+}
+
+func TestFormats(t *testing.T) {
+	for format, fields := range map[string][2]string{
+		FORMAT_GCP:   {"severity", "WARNING"},
+		FORMAT_ECS:   {"log.level", "warn"},
+		FORMAT_PLAIN: {"level", "warn"},
+	} {
+		path := initFile(t, Options{Level: "INFO", Format: format})
+		Log.Warn().Msg("message")
+		lines := readLines(t, path)
+		if len(lines) != 1 || lines[0][fields[0]] != fields[1] {
+			t.Fatalf("expected: %s %s in %s, got: %v", fields[0], fields[1], format, lines)
+		}
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	path := initFile(t, Options{Level: "WARN", Levels: map[string]string{"spool": "DEBUG", "webhook": "ERROR"}})
+	Log.Info().Msg("dropped")
+	Log.Warn().Msg("main")
+	For("spool").Debug().Msg("spool")
+	For("webhook").Warn().Msg("dropped")
+	For("webhook").Error().Msg("webhook")
+	For("outbox").Info().Msg("dropped")
+
+	lines := readLines(t, path)
+	messages := []string{}
+	for _, line := range lines {
+		messages = append(messages, line["message"].(string))
+	}
+	if strings.Join(messages, ",") != "main,spool,webhook" || lines[1]["subsystem"] != "spool" {
+		t.Fatalf("expected: main,spool,webhook, got: %v", lines)
+	}
+
+	// Without restart
+	SetLevels("WARN", nil)
+	For("spool").Debug().Msg("dropped")
+	if lines := readLines(t, path); len(lines) != 3 {
+		t.Fatalf("expected: 3 lines, got: %v", lines)
+	}
+}
+
+func TestSampled(t *testing.T) {
+	path := initFile(t, Options{Level: "DEBUG", SampleEvery: 10})
+	for range 100 {
+		Sampled().Debug().Msg("update")
+	}
+	if lines := readLines(t, path); len(lines) != 10 {
+		t.Fatalf("expected: 10 lines, got: %d", len(lines))
+	}
+}
+
+func TestForConcurrent(t *testing.T) {
+	path := initFile(t, Options{Level: "INFO", Levels: map[string]string{"spool": "DEBUG"}})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			For(fmt.Sprintf("worker%d", i)).Info().Msg("worker")
+			For("spool").Debug().Msg("spool")
+			SetLevel("INFO")
+		}()
+	}
+	wg.Wait()
+	if For("spool") != For("spool") {
+		t.Fatalf("expected: the same logger for a subsystem, got: two")
+	}
+	if lines := readLines(t, path); len(lines) != 16 {
+		t.Fatalf("expected: 16 lines, got: %d", len(lines))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("Could not open log file: %v", err)
+	}
+	defer file.Close()
+	for range 5 {
+		if _, err := file.Write([]byte("12345678\n")); err != nil {
+			t.Fatalf("Could not write log file: %v", err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if content, _ := os.ReadFile(path); len(backups) != 2 || string(content) != "12345678\n" {
+		t.Fatalf("expected: 2 backups and 1 line, got: %v and %q", backups, content)
+	}
+}
+
+func TestInitUnknownOutput(t *testing.T) {
+	if err := Init(Options{Outputs: []string{"kafka"}}); err == nil {
+		t.Fatalf("expected: error, got: nil")
+	}
+}
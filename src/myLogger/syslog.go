@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package myLogger
+
+import (
+	"io"
+	"log/syslog"
+
+	"github.com/rs/zerolog"
+)
+
+// syslogOutput sends each line to syslog with the severity of its level.
+type syslogOutput struct {
+	zerolog.LevelWriter
+	writer *syslog.Writer
+}
+
+func (s syslogOutput) Close() error {
+	return s.writer.Close()
+}
+
+// dialSyslog connects to the local socket of syslog at address, the default one of the system if empty.
+func dialSyslog(address string, tag string) (io.WriteCloser, error) {
+	network := ""
+	if address != "" {
+		network = "unixgram"
+	}
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil && address != "" {
+		// Some daemons listen on a stream socket
+		writer, err = syslog.Dial("unix", address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return syslogOutput{LevelWriter: zerolog.SyslogLevelWriter(writer), writer: writer}, nil
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package myLogger
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(address string, tag string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not available on this system")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type sequencedEvent struct {
+	seq   uint64
+	event StateChangeEvent
+}
+
+// eventBroker fans out the state changes emitted by the handlers to the /events streams. The last events are
+// kept so a client reconnecting with Last-Event-ID gets what it missed.
+// The sequence restarts at each boot, so the event ids are "<epoch>-<seq>": an id of an earlier boot resumes from the
+// oldest kept event instead of skipping the events of this boot.
+type eventBroker struct {
+	epoch       string
+	mu          sync.Mutex
+	seq         uint64
+	history     []sequencedEvent
+	historySize int
+	subscribers map[chan sequencedEvent]struct{}
+}
+
+func newEventBroker(historySize int) *eventBroker {
+	return &eventBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		historySize: max(historySize, 1),
+		subscribers: make(map[chan sequencedEvent]struct{}),
+	}
+}
+
+func (b *eventBroker) eventId(seq uint64) string {
+	return fmt.Sprintf("%s-%d", b.epoch, seq)
+}
+
+// resumeAfter returns the sequence of a Last-Event-ID, 0 if it comes from an earlier boot.
+func (b *eventBroker) resumeAfter(lastEventId string) (uint64, error) {
+	epoch, seq, found := strings.Cut(lastEventId, "-")
+	if !found {
+		return 0, fmt.Errorf("invalid Last-Event-ID: %s", lastEventId)
+	}
+	lastSeq, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Last-Event-ID: %s", lastEventId)
+	}
+	if epoch != b.epoch {
+		myLogger.For("events").Warn().Msgf("[Events] Client resumes from %s of an earlier boot, replaying every kept event", lastEventId)
+		return 0, nil
+	}
+	return lastSeq, nil
+}
+
+// Publish does nothing on a nil broker.
+func (b *eventBroker) Publish(event StateChangeEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	sequenced := sequencedEvent{seq: b.seq, event: event}
+	if len(b.history) == b.historySize {
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, sequenced)
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- sequenced:
+		default:
+			// The client is too slow: close its stream, it will reconnect with its Last-Event-ID
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Subscribe returns the kept events after lastSeq and a channel with the next ones.
+func (b *eventBroker) Subscribe(lastSeq uint64) ([]sequencedEvent, chan sequencedEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []sequencedEvent
+	for _, sequenced := range b.history {
+		if sequenced.seq > lastSeq {
+			missed = append(missed, sequenced)
+		}
+	}
+	if lastSeq > 0 && len(b.history) > 0 && b.history[0].seq > lastSeq+1 {
+		myLogger.For("events").Warn().Msgf("[Events] Client resumes from %d but the oldest kept event is %d", lastSeq, b.history[0].seq)
+	}
+
+	subscriber := make(chan sequencedEvent, 100)
+	b.subscribers[subscriber] = struct{}{}
+	return missed, subscriber
+}
+
+func (b *eventBroker) Unsubscribe(subscriber chan sequencedEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[subscriber]; ok {
+		delete(b.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+type eventFilter struct {
+	states    []string
+	keyPrefix string
+	// tenant is always checked so a client never gets the events of another tenant
+	tenant string
+}
+
+func (f eventFilter) match(event StateChangeEvent) bool {
+	if event.Tenant != f.tenant {
+		return false
+	}
+	if len(f.states) > 0 && !slices.ContainsFunc(f.states, func(state string) bool { return strings.EqualFold(state, event.State) }) {
+		return false
+	}
+	return strings.HasPrefix(event.Key, f.keyPrefix)
+}
+
+// emit sends a state change of the tenant of ctx to the /events streams and to the webhooks.
+func (s *serverContext) emit(ctx context.Context, event StateChangeEvent) {
+	event.Tenant = tenantFrom(ctx)
+	s.events.Publish(event)
+	s.webhooks.Dispatch(event.Tenant, event.Type, event)
+}
+
+func newStateChangeEvent(key string, state string) StateChangeEvent {
+	return StateChangeEvent{ID: newEventId(), Type: documentEventType(state), Key: key, State: state, Time: time.Now().UTC()}
+}
+
+// eventsHandler streams the state changes as Server-Sent Events.
+// Query parameters: state (can be repeated or comma separated) and keyPrefix.
+func (s *serverContext) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Error: streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := eventFilter{keyPrefix: r.URL.Query().Get("keyPrefix"), tenant: tenantFrom(r.Context())}
+	for _, value := range r.URL.Query()["state"] {
+		for _, state := range strings.Split(value, ",") {
+			if state = strings.TrimSpace(state); state != "" {
+				filter.states = append(filter.states, state)
+			}
+		}
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	var lastSeq uint64
+	if lastEventId != "" {
+		seq, err := s.events.resumeAfter(lastEventId)
+		if err != nil {
+			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		lastSeq = seq
+	}
+
+	missed, subscriber := s.events.Subscribe(lastSeq)
+	defer s.events.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(sequenced sequencedEvent) bool {
+		if !filter.match(sequenced.event) {
+			return true
+		}
+		data, err := json.Marshal(sequenced.event)
+		if err != nil {
+			return false
+		}
+		_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.events.eventId(sequenced.seq), sequenced.event.Type, data)
+		return err == nil
+	}
+
+	for _, sequenced := range missed {
+		if !write(sequenced) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case sequenced, ok := <-subscriber:
+			if !ok || !write(sequenced) {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseMessage struct {
+	id    string
+	event string
+	data  StateChangeEvent
+}
+
+// openEvents connects to /events and returns a channel with the received messages.
+func openEvents(t *testing.T, url string, lastEventId string) <-chan sseMessage {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Creating request failed: %v", err)
+	}
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET request (url: %s) failed: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected: status 200 with an event stream, got: %d (%s)", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	messages := make(chan sseMessage, 100)
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(resp.Body)
+		var message sseMessage
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if message.id != "" {
+					messages <- message
+				}
+				message = sseMessage{}
+			case strings.HasPrefix(line, "id: "):
+				message.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				message.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &message.data)
+			}
+		}
+	}()
+	return messages
+}
+
+func nextMessage(t *testing.T, messages <-chan sseMessage) sseMessage {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for an event")
+	}
+	return sseMessage{}
+}
+
+func TestEventsStream(t *testing.T) {
+	url := newTestServer(t, memoryStoreFactory)
+	all := openEvents(t, url+"/events", "")
+	verified := openEvents(t, url+"/events?state=verified&keyPrefix=keep", "")
+
+	for _, key := range []string{"keep1", "other1"} {
+		resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "name", Key: key})
+		expectStatus(t, resp, body, http.StatusOK)
+		doRequest(t, http.MethodPut, url+"/update/"+key+"/verified", nil)
+	}
+
+	var received []sseMessage
+	for range 4 {
+		received = append(received, nextMessage(t, all))
+	}
+	expected := []string{"keep1 document.init", "keep1 document.verified", "other1 document.init", "other1 document.verified"}
+	for i, message := range received {
+		if got := message.data.Key + " " + message.event; got != expected[i] {
+			t.Fatalf("expected: event %d to be %s, got: %s", i, expected[i], got)
+		}
+	}
+
+	message := nextMessage(t, verified)
+	if message.data.Key != "keep1" || message.data.State != STATE_VERIFIED || message.id != received[1].id {
+		t.Fatalf("expected: only the verified event of keep1, got: %+v", message)
+	}
+
+	// Reconnecting after the second event replays the ones that were missed
+	resumed := openEvents(t, url+"/events", received[1].id)
+	for _, expectedMessage := range received[2:] {
+		if message := nextMessage(t, resumed); message.id != expectedMessage.id {
+			t.Fatalf("expected: replay of event %s, got: %s", expectedMessage.id, message.id)
+		}
+	}
+
+	resp, body := doRequest(t, http.MethodGet, url+"/events?lastEventId=abc", nil)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestEventsResumeAfterRestart(t *testing.T) {
+	previous := newEventBroker(10)
+	broker := newEventBroker(10)
+	// The epochs differ even if both brokers are created in the same nanosecond
+	broker.epoch = previous.epoch + "0"
+	for _, key := range []string{"key1", "key2", "key3"} {
+		broker.Publish(newStateChangeEvent(key, STATE_INIT))
+	}
+
+	// The sequence of the earlier boot is ahead of this one
+	lastSeq, err := broker.resumeAfter(previous.eventId(5))
+	if err != nil || lastSeq != 0 {
+		t.Fatalf("expected: resume from the start, got: %d (%v)", lastSeq, err)
+	}
+	if lastSeq, err := broker.resumeAfter(broker.eventId(2)); err != nil || lastSeq != 2 {
+		t.Fatalf("expected: resume after 2, got: %d (%v)", lastSeq, err)
+	}
+	for _, id := range []string{"2", broker.epoch + "-abc"} {
+		if _, err := broker.resumeAfter(id); err == nil {
+			t.Fatalf("expected: invalid Last-Event-ID %s, got: no error", id)
+		}
+	}
+}
+
+func TestEventBrokerHistory(t *testing.T) {
+	broker := newEventBroker(2)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		broker.Publish(newStateChangeEvent(key, STATE_INIT))
+	}
+	missed, subscriber := broker.Subscribe(0)
+	defer broker.Unsubscribe(subscriber)
+	if len(missed) != 2 || missed[0].event.Key != "key2" || missed[1].seq != 3 {
+		t.Fatalf("expected: the 2 last events, got: %+v", missed)
+	}
+}
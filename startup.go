@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STAGE_STARTING   = "starting"
+	STAGE_CONNECTING = "connecting"
+	STAGE_INDEXING   = "indexing"
+	STAGE_READY      = "ready"
+)
+
+// startupState is the stage of the startup, served by /ready while the main listener is not open yet.
+type startupState struct {
+	stage atomic.Value
+}
+
+func newStartupState() *startupState {
+	res := &startupState{}
+	res.stage.Store(STAGE_STARTING)
+	return res
+}
+
+func (s *startupState) set(stage string) {
+	myLogger.For("startup").Info().Msgf("[Startup] Stage: %s", stage)
+	s.stage.Store(stage)
+}
+
+func (s *startupState) get() string {
+	return s.stage.Load().(string)
+}
+
+// ready returns true when there is no startup state: the tests build the context once the store is ready.
+func (s *serverContext) ready() bool {
+	return s.startup == nil || s.startup.get() == STAGE_READY
+}
+
+func (s *serverContext) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.ready() {
+		http.Error(w, "Starting: "+s.startup.get(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("READY"))
+}
+
+// backoff is an exponential delay between attempts, from initial to max.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+// delay returns the delay after the attempt (from 1).
+func (b backoff) delay(attempt int) time.Duration {
+	delay := b.initial
+	for i := 1; i < attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	return min(delay, b.max)
+}
+
+// retry calls fn until it succeeds or ctx is done, waiting the delay of the backoff between the attempts. The error
+// of the last attempt is returned with the one of ctx.
+func (b backoff) retry(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		delay := b.delay(attempt)
+		myLogger.For("startup").Warn().Msgf("[Startup] %s failed (attempt %d), retrying in %s: %s", name, attempt, delay, err.Error())
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: %w (last error: %s)", name, ctx.Err(), err.Error())
+		case <-timer.C:
+		}
+	}
+}
+
+// startMongo pings Mongo then ensures the indexes, both retried until the deadline of ctx. attemptTimeout bounds
+// each attempt.
+func startMongo(ctx context.Context, store *mongoStore, state *startupState, retry backoff, attemptTimeout time.Duration) error {
+	state.set(STAGE_CONNECTING)
+	err := retry.retry(ctx, "Mongo ping", func(ctx context.Context) error {
+		pingCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		defer cancel()
+		return store.Ping(pingCtx)
+	})
+	if err != nil {
+		return err
+	}
+
+	state.set(STAGE_INDEXING)
+	return retry.retry(ctx, "Mongo indexes", func(ctx context.Context) error {
+		indexCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		defer cancel()
+		return store.ensureIndexes(indexCtx)
+	})
+}
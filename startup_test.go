@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{initial: 100 * time.Millisecond, max: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, delay := range expected {
+		if got := b.delay(i + 1); got != delay {
+			t.Fatalf("expected: %s for attempt %d, got: %s", delay, i+1, got)
+		}
+	}
+}
+
+func TestBackoffRetry(t *testing.T) {
+	b := backoff{initial: time.Millisecond, max: 5 * time.Millisecond}
+
+	attempts := 0
+	err := b.retry(context.Background(), "test", func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("expected: success after 3 attempts, got: %d attempts (err: %v)", attempts, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = b.retry(ctx, "test", func(ctx context.Context) error {
+		return errors.New("unavailable")
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected: %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	ctx := &serverContext{documents: newMemoryStore(), startup: newStartupState()}
+	server := httptest.NewServer(ctx.ManagementServer())
+	defer server.Close()
+
+	ctx.startup.set(STAGE_CONNECTING)
+	for _, path := range []string{"/ready", "/health"} {
+		resp, body := doRequest(t, http.MethodGet, server.URL+path, nil)
+		expectStatus(t, resp, body, http.StatusServiceUnavailable)
+		if string(body) != "Starting: connecting\n" {
+			t.Fatalf("expected: Starting: connecting, got: %s", body)
+		}
+	}
+
+	ctx.startup.set(STAGE_READY)
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/ready", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+	if string(body) != "READY" {
+		t.Fatalf("expected: READY, got: %s", body)
+	}
+}
+
+func TestManagementDuringStartup(t *testing.T) {
+	// Like main: the management server answers before the store, the breaker and the spool are set
+	ctx := &serverContext{startup: newStartupState()}
+	server := httptest.NewServer(ctx.ManagementServer())
+	defer server.Close()
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/health/details", nil)
+	expectStatus(t, resp, body, http.StatusServiceUnavailable)
+	var details healthDetails
+	if err := json.Unmarshal(body, &details); err != nil || details.Stage != STAGE_STARTING || details.CircuitBreaker != nil {
+		t.Fatalf("expected: the startup stage only, got: %s", body)
+	}
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/metrics", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+	if !strings.Contains(string(body), "audit_ready 0") || strings.Contains(string(body), "audit_circuit_breaker") {
+		t.Fatalf("expected: audit_ready 0 only, got: %s", body)
+	}
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/openapi.json", nil)
+	expectStatus(t, resp, body, http.StatusServiceUnavailable)
+
+	ctx.documents, ctx.breaker = newMemoryStore(), newCircuitBreaker(1, time.Second, 1)
+	ctx.startup.set(STAGE_READY)
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/metrics", nil)
+	expectStatus(t, resp, body, http.StatusOK)
+	if !strings.Contains(string(body), "audit_ready 1") || !strings.Contains(string(body), "audit_circuit_breaker_state") {
+		t.Fatalf("expected: the metrics of the breaker, got: %s", body)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrInvalidStateChange = errors.New("invalid state change")
+	ErrInvalidTransition  = errors.New("invalid state transition")
+	ErrStateConflict      = errors.New("state conflict")
+)
+
+// StateChange is what UpdateState writes on the document with its new state.
+type StateChange struct {
+	State string `json:"state"`
+	// Reason is only allowed with STATE_REJECTED
+	Reason  string `json:"reason,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// UpdatedBy is the user of the request
+	UpdatedBy string `json:"-"`
+}
+
+// StateChangeRequest is the body of PUT /documents/{key}/state.
+// If ExpectedCurrentState is set, the change fails with ErrStateConflict when the document is in another state.
+type StateChangeRequest struct {
+	State                string `json:"state"`
+	Reason               string `json:"reason,omitempty"`
+	Comment              string `json:"comment,omitempty"`
+	ExpectedCurrentState string `json:"expectedCurrentState,omitempty"`
+}
+
+// stateMachine lists, for each state, the states a document can move to.
+type stateMachine map[string][]string
+
+// defaultStateMachine allows the same moves as the per-state endpoints and the batch processing.
+var defaultStateMachine = stateMachine{
+	STATE_INIT:     {STATE_VERIFIED, STATE_REJECTED, STATE_PROCESSED},
+	STATE_VERIFIED: {STATE_PROCESSED},
+	STATE_REJECTED: {STATE_PROCESSED},
+}
+
+// parseStateMachine reads transitions like: "INIT>VERIFIED|REJECTED,VERIFIED>ARCHIVED". An empty config gives the default one.
+func parseStateMachine(config string) (stateMachine, error) {
+	if strings.TrimSpace(config) == "" {
+		return defaultStateMachine, nil
+	}
+	machine := stateMachine{}
+	for _, value := range strings.Split(config, ",") {
+		from, targets, ok := strings.Cut(strings.TrimSpace(value), ">")
+		from = strings.ToUpper(strings.TrimSpace(from))
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid state transition: %s (expected: FROM>TO|TO)", value)
+		}
+		for _, to := range strings.Split(targets, "|") {
+			to = strings.ToUpper(strings.TrimSpace(to))
+			if to == "" {
+				return nil, fmt.Errorf("invalid state transition: %s (expected: FROM>TO|TO)", value)
+			}
+			if !slices.Contains(machine[from], to) {
+				machine[from] = append(machine[from], to)
+			}
+		}
+	}
+	if _, ok := machine[STATE_INIT]; !ok {
+		return nil, fmt.Errorf("the state transitions must start from %s", STATE_INIT)
+	}
+	return machine, nil
+}
+
+func (m stateMachine) isKnown(state string) bool {
+	if _, ok := m[state]; ok {
+		return true
+	}
+	for _, targets := range m {
+		if slices.Contains(targets, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns ErrInvalidStateChange for an unknown state or a reason with another state than REJECTED.
+func (m stateMachine) check(change StateChange) error {
+	if !m.isKnown(change.State) {
+		return fmt.Errorf("%w: unknown state: %s", ErrInvalidStateChange, change.State)
+	}
+	if change.Reason != "" && change.State != STATE_REJECTED {
+		return fmt.Errorf("%w: a reason is only allowed with the state %s", ErrInvalidStateChange, STATE_REJECTED)
+	}
+	return nil
+}
+
+func (m stateMachine) allows(from string, to string) bool {
+	return slices.Contains(m[from], to)
+}
+
+// sources returns the sorted states that can move to the state to.
+func (m stateMachine) sources(to string) []string {
+	var states []string
+	for from := range m {
+		if m.allows(from, to) {
+			states = append(states, from)
+		}
+	}
+	slices.Sort(states)
+	return states
+}
+
+// validate returns the error of check or ErrInvalidTransition if from can't move to change.State.
+func (m stateMachine) validate(from string, change StateChange) error {
+	if err := m.check(change); err != nil {
+		return err
+	}
+	if !m.allows(from, change.State) {
+		return fmt.Errorf("%w: from %s to %s", ErrInvalidTransition, from, change.State)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseStateMachine(t *testing.T) {
+	machine, err := parseStateMachine("")
+	if err != nil || len(machine) != len(defaultStateMachine) {
+		t.Fatalf("expected: the default state machine, got: %v (err: %v)", machine, err)
+	}
+
+	machine, err = parseStateMachine("init>verified|rejected, VERIFIED>ARCHIVED")
+	if err != nil {
+		t.Fatalf("Could not parse the state machine: %v", err)
+	}
+	if err := machine.validate(STATE_VERIFIED, StateChange{State: "ARCHIVED"}); err != nil {
+		t.Fatalf("expected: VERIFIED to ARCHIVED to be allowed, got: %v", err)
+	}
+	if err := machine.validate("ARCHIVED", StateChange{State: STATE_INIT}); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidTransition, err)
+	}
+	if err := machine.validate(STATE_INIT, StateChange{State: STATE_PROCESSED}); !errors.Is(err, ErrInvalidStateChange) {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidStateChange, err)
+	}
+
+	for _, config := range []string{"INIT", "INIT>", "VERIFIED>PROCESSED"} {
+		if _, err := parseStateMachine(config); err == nil {
+			t.Fatalf("expected: an error for %q, got: nil", config)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrNotFound     = errors.New("document not found")
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrVersionMismatch is returned when the document changed since the version the caller read
+	ErrVersionMismatch = errors.New("document version mismatch")
+)
+
+// DocumentStore is everything the handlers need to read and write MyDocument.
+// Implementations must enforce the uniqueness of MyDocument.Key.
+type DocumentStore interface {
+	Ping(ctx context.Context) error
+	// InsertDocument saves a new document. It returns an error wrapping ErrDuplicateKey if the key is already used.
+	InsertDocument(ctx context.Context, doc *MyDocument) error
+	// InsertDocuments saves new documents like InsertDocument, in as few writes as the store can. It returns the error
+	// of each document, nil for the saved ones.
+	InsertDocuments(ctx context.Context, docs []*MyDocument) []error
+	// FindDocument returns ErrNotFound if there is no document with this key.
+	FindDocument(ctx context.Context, key string) (*MyDocument, error)
+	// UpdateState moves the document identified by key from fromState to change.State, replacing its reason, comment
+	// and updatedBy, setting updatedAt and stateChangedAt and incrementing its version. If version is not 0, only the document in this version is updated.
+	// A matched document is always modified, even when the change is the same as its current state.
+	UpdateState(ctx context.Context, key string, fromState string, version int64, change StateChange) (*UpdateResult, error)
+	// UpdateDocument replaces the name, payload, labels and updatedBy of the document in this version, sets updatedAt
+	// and increments the version.
+	UpdateDocument(ctx context.Context, key string, version int64, update DocumentUpdate) (*UpdateResult, error)
+	// FindDocuments returns the documents matching the query, sorted by key.
+	FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error)
+	// UpdateStates applies the updates in one bulk write, each one like UpdateState. It returns the keys that were updated.
+	UpdateStates(ctx context.Context, updates []StateUpdate) ([]string, error)
+	// ProcessDocuments sets every given key in one of fromStates to PROCESSED, like UpdateState does. It also returns
+	// the keys that were updated.
+	ProcessDocuments(ctx context.Context, keys []string, fromStates []string, updatedBy string) (*UpdateResult, []string, error)
+}
+
+// DocumentQuery selects the documents having all the given fields. An empty query selects every document.
+type DocumentQuery struct {
+	IDs        []primitive.ObjectID
+	Keys       []string
+	State      string
+	NamePrefix string
+	// CreatedBefore is compared to the time in the ObjectID of the documents
+	CreatedBefore *time.Time
+	// StateChangedBefore uses the time in the ObjectID for the documents saved without stateChangedAt
+	StateChangedBefore *time.Time
+	Labels             map[string]string
+	// AfterKey only returns the documents after this key, to read the next page
+	AfterKey string
+	// Limit is the max number of documents returned, 0 for no limit
+	Limit int
+}
+
+// StateUpdate is one update of UpdateStates: key goes from FromState in Version to Change.
+type StateUpdate struct {
+	Key       string
+	FromState string
+	Version   int64
+	Change    StateChange
+}
+
+// UpdateResult counts the documents matched and modified by an update. The fields keep the names of the driver result
+// they replace in the JSON of /process.
+type UpdateResult struct {
+	MatchedCount  int64
+	ModifiedCount int64
+}
+
+// BatchStore keeps the MyDocumentList sent to /batch/save until they get processed.
+type BatchStore interface {
+	InsertBatch(ctx context.Context, batch *MyDocumentList) error
+	// FindBatch returns ErrNotFound if there is no batch with this id.
+	FindBatch(ctx context.Context, id primitive.ObjectID) (*MyDocumentList, error)
+}
+
+// WebhookStore keeps the webhook subscriptions and the deliveries that failed too many times.
+type WebhookStore interface {
+	InsertSubscription(ctx context.Context, subscription *WebhookSubscription) error
+	ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error)
+	// DeleteSubscription returns ErrNotFound if there is no subscription with this id.
+	DeleteSubscription(ctx context.Context, id primitive.ObjectID) error
+	InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error
+	ListDeadLetters(ctx context.Context) ([]DeadLetter, error)
+	// FindDeadLetter and DeleteDeadLetter return ErrNotFound if there is no dead letter with this id.
+	FindDeadLetter(ctx context.Context, id primitive.ObjectID) (*DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Store is implemented by every storage backend.
+type Store interface {
+	DocumentStore
+	BatchStore
+	WebhookStore
+	OutboxStore
+	RetentionStore
+}
+
+// RetentionStore deletes the documents and the batches past their retention.
+type RetentionStore interface {
+	// DeleteDocuments deletes the documents matching the query (its limit is ignored) and returns how many were deleted.
+	DeleteDocuments(ctx context.Context, query DocumentQuery) (int64, error)
+	// DeleteBatches deletes the batches created before createdBefore.
+	DeleteBatches(ctx context.Context, createdBefore time.Time) (int64, error)
+}
+
+// OutboxStore gives access to the events written with the state changes when the outbox is enabled.
+// The entries are returned in the order they were written.
+type OutboxStore interface {
+	ListOutbox(ctx context.Context, limit int) ([]OutboxEntry, error)
+	DeleteOutbox(ctx context.Context, ids []primitive.ObjectID) error
+}
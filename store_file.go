@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mongo-http-audit-service/src/myLogger"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStore is a memoryStore whose writes go first to a write-ahead log (one line per write: a JSON storeRecord,
+// or an array of them when a write changes several entities).
+// The log is replayed when the store is opened and then compacted to one record per document/batch.
+type fileStore struct {
+	*memoryStore
+	path string
+
+	fileMu sync.Mutex
+	file   *os.File
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	s.journal = s
+	return s, nil
+}
+
+func (s *fileStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var records []storeRecord
+		if err := unmarshalRecords(scanner.Bytes(), &records); err != nil {
+			// Only the last line can be incomplete (crash while writing it), it was never acknowledged
+			if !scanner.Scan() {
+				myLogger.For("filestore").Warn().Msgf("[File store] Ignoring incomplete last record (line %d) of %s", line, s.path)
+				break
+			}
+			return fmt.Errorf("corrupted record line %d of %s: %w", line, s.path, err)
+		}
+		for _, record := range records {
+			if !record.valid() {
+				return fmt.Errorf("corrupted record line %d of %s: missing id", line, s.path)
+			}
+			s.apply(record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	myLogger.For("filestore").Info().Msgf("[File store] Loaded %d documents and %d batches from %s", len(s.documents), len(s.batches), s.path)
+	return nil
+}
+
+// compact rewrites the log with only the latest version of each document and batch.
+func (s *fileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, doc := range s.documents {
+		if err := encoder.Encode(storeRecord{Document: doc}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for _, batch := range s.batches {
+		if err := encoder.Encode(storeRecord{Batch: batch}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for _, subscription := range s.subscriptions {
+		if err := encoder.Encode(storeRecord{Subscription: subscription}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for _, deadLetter := range s.deadLetters {
+		if err := encoder.Encode(storeRecord{DeadLetter: deadLetter}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for _, entry := range s.outboxEntries {
+		if err := encoder.Encode(storeRecord{Outbox: entry}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func unmarshalRecords(line []byte, records *[]storeRecord) error {
+	if len(line) > 0 && line[0] == '[' {
+		return json.Unmarshal(line, records)
+	}
+	var record storeRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+	*records = []storeRecord{record}
+	return nil
+}
+
+func (s *fileStore) append(records ...storeRecord) error {
+	// One line per write, a crash can't keep only a part of it
+	var value any = records
+	if len(records) == 1 {
+		value = records[0]
+	}
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buffer := append(line, '\n')
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	offset, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(buffer); err != nil {
+		// Don't leave half a record in the log, the next ones would be unreadable
+		s.file.Truncate(offset)
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileStore) Ping(ctx context.Context) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	return ctx.Err()
+}
+
+func (s *fileStore) Close() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
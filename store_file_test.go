@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fileStoreFactory(t *testing.T) Store {
+	store, err := newFileStore(filepath.Join(t.TempDir(), "store.wal"))
+	if err != nil {
+		t.Fatalf("Could not open file store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestHandlersFileStore(t *testing.T) {
+	testHandlers(t, fileStoreFactory)
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+	defer cancel()
+
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Could not open file store: %v", err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if err := store.InsertDocument(ctx, &MyDocument{Name: "name", Key: key, State: STATE_INIT}); err != nil {
+			t.Fatalf("Could not insert document %s: %v", key, err)
+		}
+	}
+	if _, err := store.UpdateState(ctx, "key1", STATE_INIT, 0, StateChange{State: STATE_VERIFIED}); err != nil {
+		t.Fatalf("Could not update document: %v", err)
+	}
+	batch := MyDocumentList{ToProcess: []MyDocument{{Key: "key2"}}}
+	if err := store.InsertBatch(ctx, &batch); err != nil {
+		t.Fatalf("Could not insert batch: %v", err)
+	}
+	store.Close()
+
+	// A crash while writing leaves an incomplete last line which must be ignored
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Could not open log: %v", err)
+	}
+	file.WriteString(`{"document":{"id":"6845`)
+	file.Close()
+
+	store, err = newFileStore(path)
+	if err != nil {
+		t.Fatalf("Could not reopen file store: %v", err)
+	}
+	defer store.Close()
+
+	if doc := store.documents["key1"]; doc == nil || doc.State != STATE_VERIFIED {
+		t.Fatalf("expected: key1 in state %s, got: %v", STATE_VERIFIED, doc)
+	}
+	if doc := store.documents["key2"]; doc == nil || doc.State != STATE_INIT {
+		t.Fatalf("expected: key2 in state %s, got: %v", STATE_INIT, doc)
+	}
+	if err := store.InsertDocument(ctx, &MyDocument{Name: "name", Key: "key1"}); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("expected: duplicate key error, got: %v", err)
+	}
+
+	var batches []*MyDocumentList
+	for _, b := range store.batches {
+		batches = append(batches, b)
+	}
+	if len(batches) != 1 || len(batches[0].ToProcess) != 1 || batches[0].ToProcess[0].Key != "key2" {
+		t.Fatalf("expected: the batch to be reloaded, got: %v", batches)
+	}
+}
+
+func TestFileStoreCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	os.WriteFile(path, []byte("not json\n{}\n"), 0o644)
+
+	if _, err := newFileStore(path); err == nil {
+		t.Fatalf("expected: an error opening a corrupted log, got: nil")
+	}
+}
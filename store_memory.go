@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// storeRecord is the new version of an entity after a write. Deleted is set when the entity was removed.
+type storeRecord struct {
+	Document     *MyDocument          `json:"document,omitempty"`
+	Batch        *MyDocumentList      `json:"batch,omitempty"`
+	Subscription *WebhookSubscription `json:"subscription,omitempty"`
+	DeadLetter   *DeadLetter          `json:"deadLetter,omitempty"`
+	Outbox       *OutboxEntry         `json:"outbox,omitempty"`
+	Deleted      bool                 `json:"deleted,omitempty"`
+}
+
+// valid returns false if an entity of the record has no id.
+func (r storeRecord) valid() bool {
+	return (r.Document == nil || r.Document.ID != nil) &&
+		(r.Batch == nil || r.Batch.ID != nil) &&
+		(r.Subscription == nil || r.Subscription.ID != nil) &&
+		(r.DeadLetter == nil || r.DeadLetter.ID != nil) &&
+		(r.Outbox == nil || r.Outbox.ID != nil)
+}
+
+// storeJournal persists the records of a write before it is applied in memory. The records of one call must be
+// persisted atomically.
+type storeJournal interface {
+	append(records ...storeRecord) error
+}
+
+// memoryStore keeps everything in maps. It behaves like the Mongo store (unique key, state filters)
+// so it can be used by tests or by a single instance that doesn't need persistence.
+type memoryStore struct {
+	mu        sync.RWMutex
+	documents map[string]*MyDocument
+	ids       map[primitive.ObjectID]string
+	batches   map[primitive.ObjectID]*MyDocumentList
+	journal   storeJournal
+
+	subscriptions map[primitive.ObjectID]*WebhookSubscription
+	deadLetters   map[primitive.ObjectID]*DeadLetter
+
+	outbox        bool
+	outboxEntries map[primitive.ObjectID]*OutboxEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		documents: make(map[string]*MyDocument),
+		ids:       make(map[primitive.ObjectID]string),
+		batches:   make(map[primitive.ObjectID]*MyDocumentList),
+
+		subscriptions: make(map[primitive.ObjectID]*WebhookSubscription),
+		deadLetters:   make(map[primitive.ObjectID]*DeadLetter),
+		outboxEntries: make(map[primitive.ObjectID]*OutboxEntry),
+	}
+}
+
+// commit writes the records to the journal (if any) then applies them. Must be called with the lock held.
+func (s *memoryStore) commit(records ...storeRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if s.journal != nil {
+		if err := s.journal.append(records...); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		s.apply(record)
+	}
+	return nil
+}
+
+func (s *memoryStore) apply(record storeRecord) {
+	if record.Document != nil {
+		if record.Deleted {
+			delete(s.documents, record.Document.Key)
+			delete(s.ids, *record.Document.ID)
+		} else {
+			s.documents[record.Document.Key] = record.Document
+			s.ids[*record.Document.ID] = record.Document.Key
+		}
+	}
+	if record.Batch != nil {
+		if record.Deleted {
+			delete(s.batches, *record.Batch.ID)
+		} else {
+			s.batches[*record.Batch.ID] = record.Batch
+		}
+	}
+	if record.Subscription != nil {
+		if record.Deleted {
+			delete(s.subscriptions, *record.Subscription.ID)
+		} else {
+			s.subscriptions[*record.Subscription.ID] = record.Subscription
+		}
+	}
+	if record.DeadLetter != nil {
+		if record.Deleted {
+			delete(s.deadLetters, *record.DeadLetter.ID)
+		} else {
+			s.deadLetters[*record.DeadLetter.ID] = record.DeadLetter
+		}
+	}
+	if record.Outbox != nil {
+		if record.Deleted {
+			delete(s.outboxEntries, *record.Outbox.ID)
+		} else {
+			s.outboxEntries[*record.Outbox.ID] = record.Outbox
+		}
+	}
+}
+
+// withOutbox adds the outbox entries of the events to the records when the outbox is enabled.
+func (s *memoryStore) withOutbox(records []storeRecord, events ...StateChangeEvent) []storeRecord {
+	if !s.outbox {
+		return records
+	}
+	for _, entry := range newOutboxEntries(events) {
+		records = append(records, storeRecord{Outbox: &entry})
+	}
+	return records
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *memoryStore) InsertDocument(ctx context.Context, doc *MyDocument) error {
+	return s.InsertDocuments(ctx, []*MyDocument{doc})[0]
+}
+
+// InsertDocuments checks every document, then commits the valid ones in one write.
+func (s *memoryStore) InsertDocuments(ctx context.Context, docs []*MyDocument) []error {
+	errs := make([]error, len(docs))
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The keys and ids of this call are unique too
+	keys := map[string]bool{}
+	ids := map[primitive.ObjectID]bool{}
+	records := []storeRecord{}
+	events := []StateChangeEvent{}
+	inserted := []int{}
+	for i, doc := range docs {
+		if _, exist := s.documents[doc.Key]; exist || keys[doc.Key] {
+			errs[i] = fmt.Errorf("%w: collection: %s index: keyIndex dup key: { key: \"%s\" }", ErrDuplicateKey, DocumentCollection, doc.Key)
+			continue
+		}
+		if doc.ID != nil {
+			if _, exist := s.ids[*doc.ID]; exist || ids[*doc.ID] {
+				errs[i] = fmt.Errorf("%w: collection: %s index: _id_ dup key: { _id: ObjectId('%s') }", ErrDuplicateKey, DocumentCollection, doc.ID.Hex())
+				continue
+			}
+		}
+
+		stored := *doc
+		if stored.ID == nil {
+			id := primitive.NewObjectID()
+			stored.ID = &id
+		}
+		keys[stored.Key], ids[*stored.ID] = true, true
+		records = append(records, storeRecord{Document: &stored})
+		events = append(events, newStateChangeEvent(stored.Key, stored.State))
+		inserted = append(inserted, i)
+	}
+
+	if err := s.commit(s.withOutbox(records, events...)...); err != nil {
+		for _, i := range inserted {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func (s *memoryStore) FindDocument(ctx context.Context, key string) (*MyDocument, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exist := s.documents[key]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	res := *doc
+	return &res, nil
+}
+
+// withStateChange returns a copy of doc after the change, like the update of the mongo store.
+func (doc *MyDocument) withStateChange(change StateChange) MyDocument {
+	updatedAt := now()
+	updated := *doc
+	updated.State = change.State
+	updated.Reason = change.Reason
+	updated.Comment = change.Comment
+	updated.UpdatedBy = change.UpdatedBy
+	updated.UpdatedAt = &updatedAt
+	updated.StateChangedAt = &updatedAt
+	updated.Version++
+	return updated
+}
+
+func (s *memoryStore) UpdateState(ctx context.Context, key string, fromState string, version int64, change StateChange) (*UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &UpdateResult{}
+	doc, exist := s.documents[key]
+	if !exist || doc.State != fromState || (version != 0 && doc.Version != version) {
+		return res, nil
+	}
+	res.MatchedCount = 1
+
+	updated := doc.withStateChange(change)
+	if err := s.commit(s.withOutbox([]storeRecord{{Document: &updated}}, newStateChangeEvent(key, change.State))...); err != nil {
+		return nil, err
+	}
+	res.ModifiedCount = 1
+	return res, nil
+}
+
+func (q DocumentQuery) match(doc *MyDocument) bool {
+	if len(q.IDs) > 0 && (doc.ID == nil || !slices.Contains(q.IDs, *doc.ID)) {
+		return false
+	}
+	if len(q.Keys) > 0 && !slices.Contains(q.Keys, doc.Key) {
+		return false
+	}
+	if q.AfterKey != "" && doc.Key <= q.AfterKey {
+		return false
+	}
+	if q.State != "" && doc.State != q.State {
+		return false
+	}
+	if q.CreatedBefore != nil && (doc.ID == nil || !doc.ID.Timestamp().Before(*q.CreatedBefore)) {
+		return false
+	}
+	if q.StateChangedBefore != nil {
+		switch {
+		case doc.StateChangedAt != nil:
+			if !doc.StateChangedAt.Before(*q.StateChangedBefore) {
+				return false
+			}
+		case doc.ID == nil || !doc.ID.Timestamp().Before(*q.StateChangedBefore):
+			return false
+		}
+	}
+	for label, value := range q.Labels {
+		if current, ok := doc.Labels[label]; !ok || current != value {
+			return false
+		}
+	}
+	return strings.HasPrefix(doc.Name, q.NamePrefix)
+}
+
+func (s *memoryStore) UpdateDocument(ctx context.Context, key string, version int64, update DocumentUpdate) (*UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &UpdateResult{}
+	doc, exist := s.documents[key]
+	if !exist || (version != 0 && doc.Version != version) {
+		return res, nil
+	}
+	res.MatchedCount = 1
+
+	updatedAt := now()
+	updated := *doc
+	updated.Name = update.Name
+	updated.Payload = update.Payload
+	updated.Labels = update.Labels
+	updated.UpdatedBy = update.UpdatedBy
+	updated.UpdatedAt = &updatedAt
+	updated.Version++
+	if err := s.commit(storeRecord{Document: &updated}); err != nil {
+		return nil, err
+	}
+	res.ModifiedCount = 1
+	return res, nil
+}
+
+func (s *memoryStore) FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := []MyDocument{}
+	for _, doc := range s.documents {
+		if query.match(doc) {
+			res = append(res, *doc)
+		}
+	}
+	slices.SortFunc(res, func(a, b MyDocument) int { return strings.Compare(a.Key, b.Key) })
+	if query.Limit > 0 && len(res) > query.Limit {
+		res = res[:query.Limit]
+	}
+	return res, nil
+}
+
+func (s *memoryStore) UpdateStates(ctx context.Context, updates []StateUpdate) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]storeRecord, 0, len(updates))
+	events := make([]StateChangeEvent, 0, len(updates))
+	updatedKeys := make([]string, 0, len(updates))
+	updated := make(map[string]bool, len(updates))
+	for _, update := range updates {
+		doc, exist := s.documents[update.Key]
+		if !exist || updated[update.Key] || doc.State != update.FromState || (update.Version != 0 && doc.Version != update.Version) {
+			continue
+		}
+		changed := doc.withStateChange(update.Change)
+		records = append(records, storeRecord{Document: &changed})
+		events = append(events, newStateChangeEvent(update.Key, update.Change.State))
+		updatedKeys = append(updatedKeys, update.Key)
+		updated[update.Key] = true
+	}
+
+	if err := s.commit(s.withOutbox(records, events...)...); err != nil {
+		return nil, err
+	}
+	return updatedKeys, nil
+}
+
+func (s *memoryStore) ProcessDocuments(ctx context.Context, keys []string, fromStates []string, updatedBy string) (*UpdateResult, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]storeRecord, 0, len(keys))
+	events := make([]StateChangeEvent, 0, len(keys))
+	processedKeys := make([]string, 0, len(keys))
+	updated := make(map[string]bool, len(keys))
+	logger := myLogger.Sampled()
+	for i, key := range keys {
+		logger.Debug().Msgf("Update n°%d -> key: %s", i, key)
+		doc, exist := s.documents[key]
+		if !exist || !slices.Contains(fromStates, doc.State) || updated[key] {
+			continue
+		}
+		processed := doc.withStateChange(StateChange{State: STATE_PROCESSED, Reason: doc.Reason, Comment: doc.Comment, UpdatedBy: updatedBy})
+		records = append(records, storeRecord{Document: &processed})
+		events = append(events, newStateChangeEvent(key, STATE_PROCESSED))
+		processedKeys = append(processedKeys, key)
+		updated[key] = true
+	}
+
+	myLogger.Log.Debug().Msgf("Documents to update: %d", len(keys))
+	if err := s.commit(s.withOutbox(records, events...)...); err != nil {
+		return nil, nil, err
+	}
+	count := int64(len(processedKeys))
+	return &UpdateResult{MatchedCount: count, ModifiedCount: count}, processedKeys, nil
+}
+
+func (s *memoryStore) InsertBatch(ctx context.Context, batch *MyDocumentList) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *batch
+	if stored.ID == nil {
+		id := primitive.NewObjectID()
+		stored.ID = &id
+	}
+	if _, exist := s.batches[*stored.ID]; exist {
+		return fmt.Errorf("%w: collection: %s index: _id_ dup key: { _id: ObjectId('%s') }", ErrDuplicateKey, DocumentCollectionBatch, stored.ID.Hex())
+	}
+	stored.ToProcess = append([]MyDocument(nil), batch.ToProcess...)
+	return s.commit(storeRecord{Batch: &stored})
+}
+
+func (s *memoryStore) FindBatch(ctx context.Context, id primitive.ObjectID) (*MyDocumentList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	batch, exist := s.batches[id]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	res := *batch
+	res.ToProcess = append([]MyDocument(nil), batch.ToProcess...)
+	return &res, nil
+}
+
+func (s *memoryStore) DeleteDocuments(ctx context.Context, query DocumentQuery) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []storeRecord{}
+	for _, doc := range s.documents {
+		if query.match(doc) {
+			records = append(records, storeRecord{Document: doc, Deleted: true})
+		}
+	}
+	if err := s.commit(records...); err != nil {
+		return 0, err
+	}
+	return int64(len(records)), nil
+}
+
+func (s *memoryStore) DeleteBatches(ctx context.Context, createdBefore time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []storeRecord{}
+	for id, batch := range s.batches {
+		if id.Timestamp().Before(createdBefore) {
+			records = append(records, storeRecord{Batch: batch, Deleted: true})
+		}
+	}
+	if err := s.commit(records...); err != nil {
+		return 0, err
+	}
+	return int64(len(records)), nil
+}
+
+func (s *memoryStore) InsertSubscription(ctx context.Context, subscription *WebhookSubscription) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *subscription
+	if stored.ID == nil {
+		id := primitive.NewObjectID()
+		stored.ID = &id
+	}
+	stored.EventTypes = slices.Clone(subscription.EventTypes)
+	return s.commit(storeRecord{Subscription: &stored})
+}
+
+func (s *memoryStore) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscriptions := make([]WebhookSubscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		res := *subscription
+		res.EventTypes = slices.Clone(subscription.EventTypes)
+		subscriptions = append(subscriptions, res)
+	}
+	slices.SortFunc(subscriptions, func(a, b WebhookSubscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return subscriptions, nil
+}
+
+func (s *memoryStore) DeleteSubscription(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exist := s.subscriptions[id]; !exist {
+		return ErrNotFound
+	}
+	return s.commit(storeRecord{Subscription: &WebhookSubscription{ID: &id}, Deleted: true})
+}
+
+func (s *memoryStore) InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *deadLetter
+	if stored.ID == nil {
+		id := primitive.NewObjectID()
+		stored.ID = &id
+	}
+	return s.commit(storeRecord{DeadLetter: &stored})
+}
+
+func (s *memoryStore) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deadLetters := make([]DeadLetter, 0, len(s.deadLetters))
+	for _, deadLetter := range s.deadLetters {
+		deadLetters = append(deadLetters, *deadLetter)
+	}
+	slices.SortFunc(deadLetters, func(a, b DeadLetter) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return deadLetters, nil
+}
+
+func (s *memoryStore) FindDeadLetter(ctx context.Context, id primitive.ObjectID) (*DeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deadLetter, exist := s.deadLetters[id]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	res := *deadLetter
+	return &res, nil
+}
+
+func (s *memoryStore) DeleteDeadLetter(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exist := s.deadLetters[id]; !exist {
+		return ErrNotFound
+	}
+	return s.commit(storeRecord{DeadLetter: &DeadLetter{ID: &id}, Deleted: true})
+}
+
+func (s *memoryStore) ListOutbox(ctx context.Context, limit int) ([]OutboxEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]OutboxEntry, 0, len(s.outboxEntries))
+	for _, entry := range s.outboxEntries {
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(a, b OutboxEntry) int { return bytes.Compare(a.ID[:], b.ID[:]) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) DeleteOutbox(ctx context.Context, ids []primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]storeRecord, 0, len(ids))
+	for _, id := range ids {
+		if _, exist := s.outboxEntries[id]; exist {
+			records = append(records, storeRecord{Outbox: &OutboxEntry{ID: &id}, Deleted: true})
+		}
+	}
+	return s.commit(records...)
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"reflect"
+	"regexp"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+const DocumentCollectionBatch = "documentCollectionBatch"
+
+type mongoStore struct {
+	client          *mongo.Client
+	dbName          string
+	collectionIndex map[string]bool
+	outbox          bool
+	// tenant is set on the events of the store of a tenant. With tenantField, the documents and batches of every
+	// tenant are in the same collections with their tenantId, and every filter includes it.
+	tenant      string
+	tenantField bool
+	// outboxDbName keeps the outbox in one database when each tenant has its own
+	outboxDbName string
+	// transitionWriteConcern is the write concern of the state changes, the one of the client if nil
+	transitionWriteConcern *writeconcern.WriteConcern
+}
+
+func newMongoStore(client *mongo.Client, dbName string) *mongoStore {
+	return &mongoStore{client: client, dbName: dbName, collectionIndex: make(map[string]bool)}
+}
+
+func (s *mongoStore) collection(name string, opts ...*options.CollectionOptions) *mongo.Collection {
+	dbName := s.dbName
+	if name == OutboxCollection && s.outboxDbName != "" {
+		dbName = s.outboxDbName
+	}
+	// Decodes the embedded documents of MyDocument.Payload as maps
+	return s.client.Database(dbName, options.Database().SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true})).Collection(name, opts...)
+}
+
+// transitionCollection is the documents collection with the write concern of the state changes.
+func (s *mongoStore) transitionCollection() *mongo.Collection {
+	if s.transitionWriteConcern == nil {
+		return s.collection(DocumentCollection)
+	}
+	return s.collection(DocumentCollection, options.Collection().SetWriteConcern(s.transitionWriteConcern))
+}
+
+// transitionTransaction runs fn like transaction, the transaction using the write concern of the state changes.
+func (s *mongoStore) transitionTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.transitionWriteConcern == nil {
+		return s.transaction(ctx, fn)
+	}
+	return s.transaction(ctx, fn, options.Transaction().SetWriteConcern(s.transitionWriteConcern))
+}
+
+// forTenant returns the store of a tenant: in its own database, or sharing this one if tenantField is set.
+func (s *mongoStore) forTenant(tenant string, tenantField bool) *mongoStore {
+	store := newMongoStore(s.client, s.dbName)
+	store.outbox = s.outbox
+	store.transitionWriteConcern = s.transitionWriteConcern
+	store.tenant = tenant
+	store.tenantField = tenantField
+	if !tenantField {
+		store.dbName = s.dbName + "_" + tenant
+		store.outboxDbName = s.dbName
+	}
+	return store
+}
+
+// scoped adds the tenant to the filter of the documents and batches.
+func (s *mongoStore) scoped(filter bson.M) bson.M {
+	if s.tenantField {
+		filter["tenantId"] = s.tenant
+	}
+	return filter
+}
+
+func (s *mongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *mongoStore) ensureIndex(collection *mongo.Collection, ctx context.Context) {
+	myLogger.Log.Debug().Msg("Ensure index start")
+	name := collection.Name()
+	if _, ok := s.collectionIndex[name]; ok {
+		myLogger.Log.Trace().Msg("Ensure index already ok")
+		return
+	}
+
+	if err := s.createIndexes(collection, ctx); err != nil {
+		myLogger.Log.Error().Msgf("Could not ensure index already exist. Error: %s", err.Error())
+		return
+	}
+
+	myLogger.Log.Debug().Msgf("Ensure index was ok. Adding %s to map", name)
+	s.collectionIndex[name] = true
+}
+
+// ensureIndexes creates the indexes of the documents collection at startup, before the store is shared.
+func (s *mongoStore) ensureIndexes(ctx context.Context) error {
+	collection := s.collection(DocumentCollection)
+	if err := s.createIndexes(collection, ctx); err != nil {
+		return err
+	}
+	s.collectionIndex[collection.Name()] = true
+	return nil
+}
+
+func (s *mongoStore) createIndexes(collection *mongo.Collection, ctx context.Context) error {
+	keyIndex := mongo.IndexModel{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetName("keyIndex")}
+	if s.tenantField {
+		// A key is unique for each tenant
+		keyIndex = mongo.IndexModel{Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetName("tenantKeyIndex")}
+	}
+	indexes := []mongo.IndexModel{
+		keyIndex,
+		// For the time range queries
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetName("createdAtIndex")},
+		{Keys: bson.D{{Key: "updatedAt", Value: 1}}, Options: options.Index().SetName("updatedAtIndex")},
+		{Keys: bson.D{{Key: "state", Value: 1}, {Key: "stateChangedAt", Value: 1}}, Options: options.Index().SetName("stateChangedAtIndex")},
+	}
+
+	_, err := collection.Indexes().CreateMany(ctx, indexes)
+	return err
+}
+
+// transaction runs fn in a transaction when the outbox is enabled so the outbox entries are written atomically
+// with the change. Transactions need a replica set.
+func (s *mongoStore) transaction(ctx context.Context, fn func(ctx context.Context) error, opts ...*options.TransactionOptions) error {
+	if !s.outbox {
+		return fn(ctx)
+	}
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (any, error) {
+		return nil, fn(sessionCtx)
+	}, opts...)
+	return err
+}
+
+func (s *mongoStore) writeOutbox(ctx context.Context, events ...StateChangeEvent) error {
+	if !s.outbox || len(events) == 0 {
+		return nil
+	}
+	for i := range events {
+		events[i].Tenant = s.tenant
+	}
+	entries := newOutboxEntries(events)
+	documents := make([]any, 0, len(entries))
+	for _, entry := range entries {
+		documents = append(documents, entry)
+	}
+	_, err := s.collection(OutboxCollection).InsertMany(ctx, documents)
+	return err
+}
+
+func (s *mongoStore) InsertDocument(ctx context.Context, doc *MyDocument) error {
+	collection := s.collection(DocumentCollection)
+	s.ensureIndex(collection, ctx)
+
+	if s.tenantField {
+		doc.TenantID = s.tenant
+	}
+	err := s.transaction(ctx, func(ctx context.Context) error {
+		if _, err := collection.InsertOne(ctx, doc); err != nil {
+			return err
+		}
+		return s.writeOutbox(ctx, newStateChangeEvent(doc.Key, doc.State))
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s", ErrDuplicateKey, err.Error())
+	}
+	return err
+}
+
+// InsertDocuments inserts the documents with one unordered InsertMany. With the outbox, the transaction is aborted by
+// the first error, so it is run again without the documents that failed.
+func (s *mongoStore) InsertDocuments(ctx context.Context, docs []*MyDocument) []error {
+	collection := s.collection(DocumentCollection)
+	s.ensureIndex(collection, ctx)
+
+	errs := make([]error, len(docs))
+	pending := make([]int, 0, len(docs))
+	for i, doc := range docs {
+		if s.tenantField {
+			doc.TenantID = s.tenant
+		}
+		pending = append(pending, i)
+	}
+	for len(pending) > 0 {
+		batch := make([]any, 0, len(pending))
+		events := make([]StateChangeEvent, 0, len(pending))
+		for _, i := range pending {
+			batch = append(batch, docs[i])
+			events = append(events, newStateChangeEvent(docs[i].Key, docs[i].State))
+		}
+
+		var insertErr mongo.BulkWriteException
+		err := s.transaction(ctx, func(ctx context.Context) error {
+			insertErr = mongo.BulkWriteException{}
+			if _, err := collection.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false)); err != nil {
+				errors.As(err, &insertErr)
+				return err
+			}
+			return s.writeOutbox(ctx, events...)
+		})
+		if err == nil {
+			return errs
+		}
+		if len(insertErr.WriteErrors) == 0 || insertErr.WriteConcernError != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+			return errs
+		}
+
+		failed := map[int]bool{}
+		for _, writeErr := range insertErr.WriteErrors {
+			i := pending[writeErr.Index]
+			failed[i] = true
+			errs[i] = writeErr
+			if mongo.IsDuplicateKeyError(writeErr) {
+				errs[i] = fmt.Errorf("%w: %s", ErrDuplicateKey, writeErr.Error())
+			}
+		}
+		// Without transaction the other documents are inserted
+		if !s.outbox {
+			return errs
+		}
+		pending = slices.DeleteFunc(pending, func(i int) bool { return failed[i] })
+	}
+	return errs
+}
+
+func (s *mongoStore) FindDocument(ctx context.Context, key string) (*MyDocument, error) {
+	var doc MyDocument
+	err := s.collection(DocumentCollection).FindOne(ctx, s.scoped(bson.M{"key": key})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// stateChangeUpdate sets the new state, replaces the reason, comment and updatedBy, sets the timestamps with the server
+// date and increments the version.
+func stateChangeUpdate(change StateChange) bson.M {
+	set := bson.M{"state": change.State}
+	unset := bson.M{}
+	for field, value := range map[string]string{"reason": change.Reason, "comment": change.Comment, "updatedBy": change.UpdatedBy} {
+		if value == "" {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+	update := bson.M{
+		"$set":         set,
+		"$inc":         bson.M{"version": 1},
+		"$currentDate": bson.M{"updatedAt": true, "stateChangedAt": true},
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+func (s *mongoStore) UpdateState(ctx context.Context, key string, fromState string, version int64, change StateChange) (*UpdateResult, error) {
+	filter := s.scoped(bson.M{"key": key, "state": fromState})
+	if version != 0 {
+		filter["version"] = version
+	}
+	update := stateChangeUpdate(change)
+
+	var res *UpdateResult
+	err := s.transitionTransaction(ctx, func(ctx context.Context) error {
+		updated, err := s.transitionCollection().UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		res = toUpdateResult(updated)
+		if res.ModifiedCount == 0 {
+			return nil
+		}
+		return s.writeOutbox(ctx, newStateChangeEvent(key, change.State))
+	})
+	return res, err
+}
+
+func (s *mongoStore) UpdateDocument(ctx context.Context, key string, version int64, update DocumentUpdate) (*UpdateResult, error) {
+	filter := s.scoped(bson.M{"key": key})
+	if version != 0 {
+		filter["version"] = version
+	}
+	set := bson.M{"name": update.Name}
+	unset := bson.M{}
+	for field, value := range map[string]any{"payload": update.Payload, "labels": update.Labels, "updatedBy": update.UpdatedBy} {
+		if value == nil || reflect.ValueOf(value).IsZero() {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+	change := bson.M{"$set": set, "$inc": bson.M{"version": 1}, "$currentDate": bson.M{"updatedAt": true}}
+	if len(unset) > 0 {
+		change["$unset"] = unset
+	}
+	res, err := s.collection(DocumentCollection).UpdateOne(ctx, filter, change)
+	if err != nil {
+		return nil, err
+	}
+	return toUpdateResult(res), nil
+}
+
+// toUpdateResult keeps the counts of the driver result.
+func toUpdateResult(res *mongo.UpdateResult) *UpdateResult {
+	return &UpdateResult{MatchedCount: res.MatchedCount, ModifiedCount: res.ModifiedCount}
+}
+
+// queryFilter returns the filter of the documents matching the query, without its limit.
+func (s *mongoStore) queryFilter(query DocumentQuery) bson.M {
+	filter := s.scoped(bson.M{})
+	idFilter := bson.M{}
+	if len(query.IDs) > 0 {
+		idFilter["$in"] = query.IDs
+	}
+	if query.CreatedBefore != nil {
+		idFilter["$lt"] = primitive.NewObjectIDFromTimestamp(*query.CreatedBefore)
+	}
+	if len(idFilter) > 0 {
+		filter["_id"] = idFilter
+	}
+	keyFilter := bson.M{}
+	if len(query.Keys) > 0 {
+		keyFilter["$in"] = query.Keys
+	}
+	if query.AfterKey != "" {
+		keyFilter["$gt"] = query.AfterKey
+	}
+	if len(keyFilter) > 0 {
+		filter["key"] = keyFilter
+	}
+	if query.State != "" {
+		filter["state"] = query.State
+	}
+	if query.NamePrefix != "" {
+		filter["name"] = bson.M{"$regex": "^" + regexp.QuoteMeta(query.NamePrefix)}
+	}
+	for label, value := range query.Labels {
+		filter["labels."+label] = value
+	}
+	if query.StateChangedBefore != nil {
+		filter["$or"] = bson.A{
+			bson.M{"stateChangedAt": bson.M{"$lt": *query.StateChangedBefore}},
+			bson.M{"stateChangedAt": bson.M{"$exists": false}, "_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(*query.StateChangedBefore)}},
+		}
+	}
+	return filter
+}
+
+func (s *mongoStore) FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error) {
+	filter := s.queryFilter(query)
+	opts := options.Find().SetSort(bson.M{"key": 1})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	cursor, err := s.collection(DocumentCollection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := []MyDocument{}
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateStates can't know from the bulk result which updates matched: when some did not, it looks for the documents
+// now in the version and state the updates set.
+func (s *mongoStore) UpdateStates(ctx context.Context, updates []StateUpdate) ([]string, error) {
+	if len(updates) == 0 {
+		return []string{}, nil
+	}
+	collection := s.transitionCollection()
+
+	models := make([]mongo.WriteModel, 0, len(updates))
+	for _, update := range updates {
+		filter := s.scoped(bson.M{"key": update.Key, "state": update.FromState})
+		if update.Version != 0 {
+			filter["version"] = update.Version
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(stateChangeUpdate(update.Change)))
+	}
+
+	states := make(map[string]string, len(updates))
+	for _, update := range updates {
+		states[update.Key] = update.Change.State
+	}
+
+	var updatedKeys []string
+	err := s.transitionTransaction(ctx, func(ctx context.Context) error {
+		res, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+
+		updatedKeys = make([]string, 0, len(updates))
+		if res.ModifiedCount == int64(len(updates)) {
+			for _, update := range updates {
+				updatedKeys = append(updatedKeys, update.Key)
+			}
+		} else {
+			or := make([]bson.M, 0, len(updates))
+			for _, update := range updates {
+				or = append(or, s.scoped(bson.M{"key": update.Key, "state": update.Change.State, "version": update.Version + 1}))
+			}
+			cursor, err := collection.Find(ctx, bson.M{"$or": or}, options.Find().SetProjection(bson.M{"key": 1}))
+			if err != nil {
+				return err
+			}
+			var updated []MyDocument
+			if err := cursor.All(ctx, &updated); err != nil {
+				return err
+			}
+			for _, doc := range updated {
+				updatedKeys = append(updatedKeys, doc.Key)
+			}
+		}
+
+		events := make([]StateChangeEvent, 0, len(updatedKeys))
+		for _, key := range updatedKeys {
+			events = append(events, newStateChangeEvent(key, states[key]))
+		}
+		return s.writeOutbox(ctx, events...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updatedKeys, nil
+}
+
+// ProcessDocuments looks for the keys in one of fromStates before the bulk write to know which ones it updates.
+// Without the outbox (no transaction), a key processed concurrently by another request between the two can be returned by both.
+func (s *mongoStore) ProcessDocuments(ctx context.Context, keys []string, fromStates []string, updatedBy string) (*UpdateResult, []string, error) {
+	collection := s.transitionCollection()
+
+	// Keeps the reason and comment of the documents
+	processUpdate := bson.M{
+		"$set":         bson.M{"state": STATE_PROCESSED, "updatedBy": updatedBy},
+		"$inc":         bson.M{"version": 1},
+		"$currentDate": bson.M{"updatedAt": true, "stateChangedAt": true},
+	}
+	if updatedBy == "" {
+		processUpdate["$set"] = bson.M{"state": STATE_PROCESSED}
+		processUpdate["$unset"] = bson.M{"updatedBy": ""}
+	}
+
+	updates := make([]mongo.WriteModel, 0, len(keys))
+	logger := myLogger.Sampled()
+	for i, key := range keys {
+		logger.Debug().Msgf("Update n°%d -> key: %s", i, key)
+		updates = append(updates,
+			mongo.NewUpdateOneModel().
+				SetFilter(s.scoped(bson.M{"key": key, "state": bson.M{"$in": fromStates}})).
+				SetUpdate(processUpdate),
+		)
+	}
+	myLogger.Log.Debug().Msgf("Documents to update: %d", len(updates))
+
+	var res *UpdateResult
+	var processedKeys []string
+	err := s.transitionTransaction(ctx, func(ctx context.Context) error {
+		filter := s.scoped(bson.M{"key": bson.M{"$in": keys}, "state": bson.M{"$in": fromStates}})
+		cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"key": 1}))
+		if err != nil {
+			return err
+		}
+		var toProcess []MyDocument
+		if err := cursor.All(ctx, &toProcess); err != nil {
+			return err
+		}
+
+		written, err := collection.BulkWrite(ctx, updates)
+		if err != nil {
+			return err
+		}
+		res = &UpdateResult{MatchedCount: written.MatchedCount, ModifiedCount: written.ModifiedCount}
+
+		processedKeys = make([]string, 0, len(toProcess))
+		events := make([]StateChangeEvent, 0, len(toProcess))
+		for _, doc := range toProcess {
+			processedKeys = append(processedKeys, doc.Key)
+			events = append(events, newStateChangeEvent(doc.Key, STATE_PROCESSED))
+		}
+		return s.writeOutbox(ctx, events...)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, processedKeys, nil
+}
+
+func (s *mongoStore) InsertBatch(ctx context.Context, batch *MyDocumentList) error {
+	if s.tenantField {
+		batch.TenantID = s.tenant
+	}
+	_, err := s.collection(DocumentCollectionBatch).InsertOne(ctx, batch)
+	return err
+}
+
+func (s *mongoStore) FindBatch(ctx context.Context, id primitive.ObjectID) (*MyDocumentList, error) {
+	var batch MyDocumentList
+	err := s.collection(DocumentCollectionBatch).FindOne(ctx, s.scoped(bson.M{"_id": id})).Decode(&batch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+func (s *mongoStore) DeleteDocuments(ctx context.Context, query DocumentQuery) (int64, error) {
+	res, err := s.collection(DocumentCollection).DeleteMany(ctx, s.queryFilter(query))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (s *mongoStore) DeleteBatches(ctx context.Context, createdBefore time.Time) (int64, error) {
+	filter := s.scoped(bson.M{"_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(createdBefore)}})
+	res, err := s.collection(DocumentCollectionBatch).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// ArchiveDocuments copies the documents in DocumentCollectionArchive, replacing the ones already archived.
+func (s *mongoStore) ArchiveDocuments(ctx context.Context, docs []MyDocument) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(docs))
+	for _, doc := range docs {
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": doc.ID}).SetReplacement(doc).SetUpsert(true))
+	}
+	_, err := s.collection(DocumentCollectionArchive).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *mongoStore) InsertSubscription(ctx context.Context, subscription *WebhookSubscription) error {
+	_, err := s.collection(WebhookSubscriptionCollection).InsertOne(ctx, subscription)
+	return err
+}
+
+func (s *mongoStore) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	cursor, err := s.collection(WebhookSubscriptionCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := []WebhookSubscription{}
+	err = cursor.All(ctx, &subscriptions)
+	return subscriptions, err
+}
+
+func (s *mongoStore) DeleteSubscription(ctx context.Context, id primitive.ObjectID) error {
+	return s.deleteById(ctx, WebhookSubscriptionCollection, id)
+}
+
+func (s *mongoStore) InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	_, err := s.collection(WebhookDeadLetterCollection).InsertOne(ctx, deadLetter)
+	return err
+}
+
+func (s *mongoStore) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	cursor, err := s.collection(WebhookDeadLetterCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	deadLetters := []DeadLetter{}
+	err = cursor.All(ctx, &deadLetters)
+	return deadLetters, err
+}
+
+func (s *mongoStore) FindDeadLetter(ctx context.Context, id primitive.ObjectID) (*DeadLetter, error) {
+	var deadLetter DeadLetter
+	err := s.collection(WebhookDeadLetterCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&deadLetter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetter, nil
+}
+
+func (s *mongoStore) DeleteDeadLetter(ctx context.Context, id primitive.ObjectID) error {
+	return s.deleteById(ctx, WebhookDeadLetterCollection, id)
+}
+
+func (s *mongoStore) deleteById(ctx context.Context, collectionName string, id primitive.ObjectID) error {
+	res, err := s.collection(collectionName).DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) ListOutbox(ctx context.Context, limit int) ([]OutboxEntry, error) {
+	cursor, err := s.collection(OutboxCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	entries := []OutboxEntry{}
+	err = cursor.All(ctx, &entries)
+	return entries, err
+}
+
+func (s *mongoStore) DeleteOutbox(ctx context.Context, ids []primitive.ObjectID) error {
+	_, err := s.collection(OutboxCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
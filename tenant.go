@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	TENANCY_NONE     = "none"
+	TENANCY_DATABASE = "database"
+	TENANCY_FIELD    = "field"
+
+	HEADER_TENANT = "X-Tenant-ID"
+)
+
+var (
+	ErrTenantRequired = errors.New("tenant required")
+	ErrInvalidTenant  = errors.New("invalid tenant")
+	ErrTenantMismatch = errors.New("tenant mismatch")
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrUnknownTenant  = errors.New("unknown tenant")
+	ErrTooManyTenants = errors.New("too many tenants")
+)
+
+var tenantRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,48}$`)
+
+// tenantFilter is the list and the pattern of the tenants that can be used, the stores of the others are never
+// opened. A nil filter allows every tenant.
+type tenantFilter struct {
+	names   []string
+	pattern *regexp.Regexp
+}
+
+func newTenantFilter(names string, pattern string) (*tenantFilter, error) {
+	f := &tenantFilter{names: splitList(names)}
+	for _, name := range f.names {
+		if !tenantRegexp.MatchString(name) {
+			return nil, fmt.Errorf("%w: %q (expected: %s)", ErrInvalidTenant, name, tenantRegexp.String())
+		}
+	}
+	if pattern != "" {
+		// The whole tenant must match
+		compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		f.pattern = compiled
+	}
+	return f, nil
+}
+
+func (f *tenantFilter) allows(tenant string) bool {
+	if f == nil {
+		return true
+	}
+	return slices.Contains(f.names, tenant) || (f.pattern != nil && f.pattern.MatchString(tenant))
+}
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant of the request, empty without tenancy.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenancy finds the tenant of the requests in a claim of the bearer token, or in the X-Tenant-ID header when there
+// is no jwtSecret.
+type tenancy struct {
+	// jwtSecret verifies the HS256 bearer tokens. When it is set, a valid token is required and the header can only
+	// repeat its tenant.
+	jwtSecret []byte
+	claim     string
+	allowed   *tenantFilter
+}
+
+// resolve returns the tenant of the claim, or of the header without jwtSecret.
+func (t *tenancy) resolve(header string, authorization string) (string, error) {
+	header = strings.TrimSpace(header)
+	tenant := header
+	if len(t.jwtSecret) > 0 {
+		token, ok := strings.CutPrefix(authorization, "Bearer ")
+		if !ok {
+			return "", fmt.Errorf("%w: a bearer token with the claim %s is required", ErrInvalidToken, t.claim)
+		}
+		claims, err := verifyJwt(strings.TrimSpace(token), t.jwtSecret)
+		if err != nil {
+			return "", err
+		}
+		claimed, _ := claims[t.claim].(string)
+		if claimed == "" {
+			return "", fmt.Errorf("%w: the token has no claim %s", ErrInvalidToken, t.claim)
+		}
+		if header != "" && claimed != header {
+			return "", fmt.Errorf("%w: %s doesn't match the tenant of the token", ErrTenantMismatch, HEADER_TENANT)
+		}
+		tenant = claimed
+	}
+
+	if tenant == "" {
+		return "", fmt.Errorf("%w: set %s", ErrTenantRequired, HEADER_TENANT)
+	}
+	if !tenantRegexp.MatchString(tenant) {
+		return "", fmt.Errorf("%w: %q (expected: %s)", ErrInvalidTenant, tenant, tenantRegexp.String())
+	}
+	if !t.allowed.allows(tenant) {
+		return "", fmt.Errorf("%w: %s", ErrUnknownTenant, tenant)
+	}
+	return tenant, nil
+}
+
+// verifyJwt checks the HS256 signature and the expiration of the token and returns its claims.
+func verifyJwt(token string, secret []byte) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: expected an HS256 token", ErrInvalidToken)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Now().Unix() >= int64(exp) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+func decodeJwtPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// isTenantScoped is false for the routes that are not about the data of a tenant: the main page.
+func isTenantScoped(pattern string) bool {
+	_, path, _ := strings.Cut(pattern, " ")
+	return path != "/"
+}
+
+// isTenantScopedMethod is false for the gRPC health checks, which answer the probes without a tenant like the HTTP ones.
+func isTenantScopedMethod(fullMethod string) bool {
+	return !strings.HasPrefix(fullMethod, "/"+grpc_health_v1.Health_ServiceDesc.ServiceName+"/")
+}
+
+func (s *serverContext) tenantHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isTenantScoped(r.Pattern) {
+			handler(w, r)
+			return
+		}
+		tenant, err := s.tenancy.resolve(r.Header.Get(HEADER_TENANT), r.Header.Get("Authorization"))
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			http.Error(w, "Error: "+err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrTenantMismatch), errors.Is(err, ErrUnknownTenant):
+			http.Error(w, "Error: "+err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler(w, r.WithContext(withTenant(r.Context(), tenant)))
+	}
+}
+
+func (s *serverContext) grpcTenant(ctx context.Context) (context.Context, error) {
+	if s.tenancy == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	tenant, err := s.tenancy.resolve(first(HEADER_TENANT), first("authorization"))
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrTenantMismatch), errors.Is(err, ErrUnknownTenant):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return withTenant(ctx, tenant), nil
+}
+
+// tenantUnaryInterceptor and tenantStreamInterceptor read the tenant from the x-tenant-id or authorization metadata.
+func (s *serverContext) tenantUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !isTenantScopedMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	ctx, err := s.grpcTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type tenantServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tenantServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverContext) tenantStreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !isTenantScopedMethod(info.FullMethod) {
+		return handler(srv, stream)
+	}
+	ctx, err := s.grpcTenant(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &tenantServerStream{ServerStream: stream, ctx: ctx})
+}
+
+// tenantRouter sends each call to the store of the tenant of the context, opening it the first time.
+// It implements DocumentStore and BatchStore so the handlers don't know about the tenants.
+type tenantRouter struct {
+	mu      sync.Mutex
+	base    Store
+	open    func(tenant string) (Store, error)
+	allowed *tenantFilter
+	// maxStores bounds the stores kept open, 0 for no limit. They are never closed before the end as their
+	// requests may still be running.
+	maxStores int
+	stores    map[string]Store
+}
+
+func newTenantRouter(base Store, open func(tenant string) (Store, error), allowed *tenantFilter, maxStores int) *tenantRouter {
+	return &tenantRouter{base: base, open: open, allowed: allowed, maxStores: maxStores, stores: make(map[string]Store)}
+}
+
+func (t *tenantRouter) store(ctx context.Context) (Store, error) {
+	tenant := tenantFrom(ctx)
+	if tenant == "" {
+		return nil, ErrTenantRequired
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if store, ok := t.stores[tenant]; ok {
+		return store, nil
+	}
+	if !t.allowed.allows(tenant) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, tenant)
+	}
+	if t.maxStores > 0 && len(t.stores) >= t.maxStores {
+		return nil, fmt.Errorf("%w: %d stores open (tenantMaxStores)", ErrTooManyTenants, len(t.stores))
+	}
+	store, err := t.open(tenant)
+	if err != nil {
+		return nil, err
+	}
+	t.stores[tenant] = store
+	return store, nil
+}
+
+// Close closes the stores of the tenants that can be closed.
+func (t *tenantRouter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	for _, store := range t.stores {
+		if closer, ok := store.(interface{ Close() error }); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *tenantRouter) Ping(ctx context.Context) error {
+	return t.base.Ping(ctx)
+}
+
+func (t *tenantRouter) InsertDocument(ctx context.Context, doc *MyDocument) error {
+	store, err := t.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.InsertDocument(ctx, doc)
+}
+
+func (t *tenantRouter) InsertDocuments(ctx context.Context, docs []*MyDocument) []error {
+	store, err := t.store(ctx)
+	if err != nil {
+		errs := make([]error, len(docs))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	return store.InsertDocuments(ctx, docs)
+}
+
+func (t *tenantRouter) FindDocument(ctx context.Context, key string) (*MyDocument, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindDocument(ctx, key)
+}
+
+func (t *tenantRouter) UpdateState(ctx context.Context, key string, fromState string, version int64, change StateChange) (*UpdateResult, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.UpdateState(ctx, key, fromState, version, change)
+}
+
+func (t *tenantRouter) UpdateDocument(ctx context.Context, key string, version int64, update DocumentUpdate) (*UpdateResult, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.UpdateDocument(ctx, key, version, update)
+}
+
+func (t *tenantRouter) FindDocuments(ctx context.Context, query DocumentQuery) ([]MyDocument, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindDocuments(ctx, query)
+}
+
+func (t *tenantRouter) UpdateStates(ctx context.Context, updates []StateUpdate) ([]string, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.UpdateStates(ctx, updates)
+}
+
+func (t *tenantRouter) ProcessDocuments(ctx context.Context, keys []string, fromStates []string, updatedBy string) (*UpdateResult, []string, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.ProcessDocuments(ctx, keys, fromStates, updatedBy)
+}
+
+func (t *tenantRouter) InsertBatch(ctx context.Context, batch *MyDocumentList) error {
+	store, err := t.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.InsertBatch(ctx, batch)
+}
+
+func (t *tenantRouter) FindBatch(ctx context.Context, id primitive.ObjectID) (*MyDocumentList, error) {
+	store, err := t.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindBatch(ctx, id)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func signJwt(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Error marshaling claims: %v", err)
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTenancyResolve(t *testing.T) {
+	tenants := &tenancy{jwtSecret: []byte("secret"), claim: "tenant_id"}
+	valid := "Bearer " + signJwt(t, "secret", map[string]any{"tenant_id": "acme"})
+	expired := "Bearer " + signJwt(t, "secret", map[string]any{"tenant_id": "acme", "exp": time.Now().Add(-time.Minute).Unix()})
+	forged := "Bearer " + signJwt(t, "other", map[string]any{"tenant_id": "acme"})
+	noClaim := "Bearer " + signJwt(t, "secret", map[string]any{"sub": "user"})
+
+	tests := []struct {
+		header        string
+		authorization string
+		expected      string
+		err           error
+	}{
+		// With a secret, the header alone is not enough
+		{header: "acme", err: ErrInvalidToken},
+		{authorization: valid, expected: "acme"},
+		{header: "acme", authorization: valid, expected: "acme"},
+		{header: "other", authorization: valid, err: ErrTenantMismatch},
+		{authorization: expired, err: ErrInvalidToken},
+		{authorization: forged, err: ErrInvalidToken},
+		{authorization: "Bearer not-a-token", err: ErrInvalidToken},
+		{authorization: noClaim, err: ErrInvalidToken},
+		{err: ErrInvalidToken},
+	}
+	for _, test := range tests {
+		tenant, err := tenants.resolve(test.header, test.authorization)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("expected: error %v for %q/%q, got: %v", test.err, test.header, test.authorization, err)
+		}
+		if tenant != test.expected {
+			t.Fatalf("expected: tenant %q, got: %q", test.expected, tenant)
+		}
+	}
+
+	// Without secret, the header gives the tenant
+	headers := &tenancy{claim: "tenant_id"}
+	if tenant, err := headers.resolve("acme", ""); err != nil || tenant != "acme" {
+		t.Fatalf("expected: tenant acme, got: %q (err: %v)", tenant, err)
+	}
+	if _, err := headers.resolve("", ""); !errors.Is(err, ErrTenantRequired) {
+		t.Fatalf("expected: error %v, got: %v", ErrTenantRequired, err)
+	}
+	if _, err := headers.resolve("../acme", ""); !errors.Is(err, ErrInvalidTenant) {
+		t.Fatalf("expected: error %v, got: %v", ErrInvalidTenant, err)
+	}
+}
+
+func newTenantTestServer(t *testing.T) string {
+	store := newMemoryStore()
+	allowed, err := newTenantFilter("acme,globex", "")
+	if err != nil {
+		t.Fatalf("Could not create tenant filter: %v", err)
+	}
+	tenants := newTenantRouter(store, func(tenant string) (Store, error) {
+		return newMemoryStore(), nil
+	}, allowed, 0)
+	ctx := &serverContext{documents: tenants, batches: tenants, webhooks: newWebhookDispatcher(store, 3, 10*time.Millisecond, time.Second, 5*time.Second),
+		events: newEventBroker(100), tenancy: &tenancy{claim: "tenant_id", allowed: allowed}, adminToken: testAdminToken}
+	server := httptest.NewServer(ctx.MainServer(true))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestTenantIsolation(t *testing.T) {
+	url := newTenantTestServer(t)
+	acme := http.Header{HEADER_TENANT: {"acme"}}
+	globex := http.Header{HEADER_TENANT: {"globex"}}
+
+	// The probes don't need a tenant
+	for _, path := range []string{"/health", "/ready", "/metrics"} {
+		resp, body := doRequest(t, http.MethodGet, url+path, nil)
+		expectStatus(t, resp, body, http.StatusOK)
+	}
+
+	resp, body := doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"})
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	resp, body = doRequestWithHeader(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"}, http.Header{HEADER_TENANT: {"initech"}})
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = doRequestWithHeader(t, http.MethodPost, url+"/save", MyDocument{Name: "test1", Key: "key1"}, acme)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	// The same key can be used by another tenant
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/documents/key1", nil, globex)
+	expectStatus(t, resp, body, http.StatusNotFound)
+	resp, body = doRequestWithHeader(t, http.MethodPost, url+"/save", MyDocument{Name: "test2", Key: "key1"}, globex)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/documents/key1", nil, acme)
+	expectStatus(t, resp, body, http.StatusOK)
+	var doc MyDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("Error decoding document: %v", err)
+	}
+	if doc.Name != "test1" {
+		t.Fatalf("expected: name test1, got: %s", doc.Name)
+	}
+
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/documents", nil, globex)
+	expectStatus(t, resp, body, http.StatusOK)
+	var docs []MyDocument
+	if err := json.Unmarshal(body, &docs); err != nil {
+		t.Fatalf("Error decoding documents: %v", err)
+	}
+	if len(docs) != 1 || docs[0].Name != "test2" {
+		t.Fatalf("expected: only the document of globex, got: %v", docs)
+	}
+
+	// Each tenant only sees its own webhooks
+	acme.Set(HEADER_ADMIN_TOKEN, testAdminToken)
+	globex.Set(HEADER_ADMIN_TOKEN, testAdminToken)
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/admin/webhooks", nil, adminHeader)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	resp, body = doRequestWithHeader(t, http.MethodPost, url+"/admin/webhooks", WebhookSubscription{URL: "https://example.com/hook", EventTypes: []string{"*"}, Secret: "secret"}, acme)
+	expectStatus(t, resp, body, http.StatusCreated)
+	var subscription WebhookSubscription
+	if err := json.Unmarshal(body, &subscription); err != nil || subscription.Tenant != "acme" {
+		t.Fatalf("expected: subscription of acme, got: %s", body)
+	}
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/admin/webhooks", nil, globex)
+	expectStatus(t, resp, body, http.StatusOK)
+	var subscriptions []WebhookSubscription
+	if err := json.Unmarshal(body, &subscriptions); err != nil || len(subscriptions) != 0 {
+		t.Fatalf("expected: no subscription for globex, got: %s", body)
+	}
+	resp, body = doRequestWithHeader(t, http.MethodDelete, url+"/admin/webhooks/"+subscription.ID.Hex(), nil, globex)
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestWebhookTenantFilter(t *testing.T) {
+	store := newMemoryStore()
+	webhooks := newWebhookDispatcher(store, 1, 0, time.Second, 5*time.Second)
+	for _, tenant := range []string{"acme", "globex"} {
+		id := primitive.NewObjectID()
+		if err := store.InsertSubscription(context.Background(), &WebhookSubscription{ID: &id, URL: "https://example.com/" + tenant, EventTypes: []string{"*"}, Secret: "secret", Tenant: tenant}); err != nil {
+			t.Fatalf("Could not insert subscription: %v", err)
+		}
+	}
+
+	if err := webhooks.refresh(context.Background()); err != nil {
+		t.Fatalf("Could not load subscriptions: %v", err)
+	}
+	webhooks.Dispatch("acme", "document.verified", StateChangeEvent{Key: "key1", Tenant: "acme"})
+	if len(webhooks.queue) != 1 {
+		t.Fatalf("expected: 1 delivery, got: %d", len(webhooks.queue))
+	}
+	if delivery := <-webhooks.queue; delivery.subscription.Tenant != "acme" {
+		t.Fatalf("expected: delivery to acme, got: %s", delivery.subscription.Tenant)
+	}
+}
+
+func TestTenantRouterLimits(t *testing.T) {
+	allowed, err := newTenantFilter("acme", "team-[0-9]+")
+	if err != nil {
+		t.Fatalf("Could not create tenant filter: %v", err)
+	}
+	opened := 0
+	tenants := newTenantRouter(newMemoryStore(), func(tenant string) (Store, error) {
+		opened++
+		return newMemoryStore(), nil
+	}, allowed, 2)
+
+	for tenant, expected := range map[string]error{"other": ErrUnknownTenant, "team-1x": ErrUnknownTenant} {
+		if _, err := tenants.store(withTenant(context.Background(), tenant)); !errors.Is(err, expected) {
+			t.Fatalf("expected: error %v for %s, got: %v", expected, tenant, err)
+		}
+	}
+	for _, tenant := range []string{"acme", "team-1", "acme"} {
+		if _, err := tenants.store(withTenant(context.Background(), tenant)); err != nil {
+			t.Fatalf("expected: store of %s, got: %v", tenant, err)
+		}
+	}
+	if _, err := tenants.store(withTenant(context.Background(), "team-2")); !errors.Is(err, ErrTooManyTenants) {
+		t.Fatalf("expected: error %v, got: %v", ErrTooManyTenants, err)
+	}
+	if opened != 2 {
+		t.Fatalf("expected: 2 stores opened, got: %d", opened)
+	}
+
+	if _, err := newTenantFilter("../acme", ""); !errors.Is(err, ErrInvalidTenant) {
+		t.Fatalf("expected: error %v, got: %v", ErrInvalidTenant, err)
+	}
+}
+
+func TestSseTenantFilter(t *testing.T) {
+	filter := eventFilter{tenant: "acme"}
+	if !filter.match(StateChangeEvent{Key: "key1", Tenant: "acme"}) {
+		t.Fatalf("expected: event of acme to match")
+	}
+	if filter.match(StateChangeEvent{Key: "key1", Tenant: "globex"}) {
+		t.Fatalf("expected: event of globex not to match")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mongo-http-audit-service/src/myLogger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const bulkTransitionChunkSize = 500
+
+// DocumentFilter selects the documents of a bulk transition, every field set must match.
+type DocumentFilter struct {
+	State         string            `json:"state,omitempty"`
+	NamePrefix    string            `json:"namePrefix,omitempty"`
+	CreatedBefore *time.Time        `json:"createdBefore,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+func (f DocumentFilter) isEmpty() bool {
+	return f.State == "" && f.NamePrefix == "" && f.CreatedBefore == nil && len(f.Labels) == 0
+}
+
+// BulkTransitionRequest is the body of POST /documents/transition. Exactly one of Keys and Filter must be set, an
+// empty Filter selects every document and must be confirmed with All.
+type BulkTransitionRequest struct {
+	Keys    []string        `json:"keys,omitempty"`
+	Filter  *DocumentFilter `json:"filter,omitempty"`
+	All     bool            `json:"all,omitempty"`
+	State   string          `json:"state"`
+	Reason  string          `json:"reason,omitempty"`
+	Comment string          `json:"comment,omitempty"`
+	DryRun  bool            `json:"dryRun,omitempty"`
+}
+
+// BulkTransitionResult counts the selected documents: the ones the state machine doesn't allow to move are skipped,
+// the others are affected unless they changed during the transition (conflicts). Nothing is written in dry-run mode.
+type BulkTransitionResult struct {
+	DryRun    bool  `json:"dryRun"`
+	Selected  int64 `json:"selected"`
+	Affected  int64 `json:"affected"`
+	Skipped   int64 `json:"skipped"`
+	Conflicts int64 `json:"conflicts"`
+}
+
+// bulkTransition moves the selected documents to req.State. They are read and moved by pages of
+// bulkTransitionChunkSize, each page starts after the last key of the previous one.
+func (s *serverContext) bulkTransition(ctx context.Context, req BulkTransitionRequest) (*BulkTransitionResult, error) {
+	change := StateChange{State: strings.ToUpper(strings.TrimSpace(req.State)), Reason: req.Reason, Comment: req.Comment, UpdatedBy: actorFrom(ctx)}
+	if change.State == "" {
+		return nil, fmt.Errorf("%w: state can't be empty", ErrInvalidStateChange)
+	}
+	if (len(req.Keys) == 0) == (req.Filter == nil) {
+		return nil, fmt.Errorf("%w: expected either keys or filter", ErrInvalidStateChange)
+	}
+	if req.Filter != nil && req.Filter.isEmpty() && !req.All {
+		return nil, fmt.Errorf("%w: an empty filter selects every document, set all to confirm", ErrInvalidStateChange)
+	}
+	machine := s.stateMachine()
+	if err := machine.check(change); err != nil {
+		return nil, err
+	}
+
+	query := DocumentQuery{Keys: req.Keys, Limit: bulkTransitionChunkSize}
+	if req.Filter != nil {
+		query.State = strings.ToUpper(req.Filter.State)
+		query.NamePrefix = req.Filter.NamePrefix
+		query.CreatedBefore = req.Filter.CreatedBefore
+		query.Labels = req.Filter.Labels
+	}
+
+	res := &BulkTransitionResult{DryRun: req.DryRun}
+	for {
+		ctxRead, cancelRead := context.WithTimeout(ctx, s.runtime().bulkTimeout)
+		docs, err := s.documents.FindDocuments(ctxRead, query)
+		cancelRead()
+		if err != nil {
+			return nil, err
+		}
+
+		res.Selected += int64(len(docs))
+		updates := make([]StateUpdate, 0, len(docs))
+		for _, doc := range docs {
+			if !machine.allows(doc.State, change.State) {
+				res.Skipped++
+				continue
+			}
+			updates = append(updates, StateUpdate{Key: doc.Key, FromState: doc.State, Version: doc.Version, Change: change})
+		}
+		if req.DryRun {
+			res.Affected += int64(len(updates))
+		} else if len(updates) > 0 {
+			ctxWrite, cancelWrite := context.WithTimeout(ctx, s.runtime().bulkTimeout)
+			updatedKeys, err := s.documents.UpdateStates(ctxWrite, updates)
+			cancelWrite()
+			if err != nil {
+				return nil, err
+			}
+			res.Affected += int64(len(updatedKeys))
+			res.Conflicts += int64(len(updates) - len(updatedKeys))
+			for _, key := range updatedKeys {
+				s.emit(ctx, newStateChangeEvent(key, change.State))
+			}
+		}
+
+		if len(docs) < bulkTransitionChunkSize {
+			break
+		}
+		query.AfterKey = docs[len(docs)-1].Key
+	}
+	myLogger.Log.Debug().Msgf("Bulk transition to %s: %+v", change.State, *res)
+	return res, nil
+}
+
+func (s *serverContext) bulkTransitionHandler(w http.ResponseWriter, r *http.Request) {
+	var req BulkTransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.bulkTransition(r.Context(), req)
+	if err != nil {
+		if circuitOpenResponse(w, err) {
+			return
+		}
+		if errors.Is(err, ErrInvalidStateChange) {
+			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
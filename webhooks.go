@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mongo-http-audit-service/src/myLogger"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrForbiddenTarget = errors.New("webhooks can't target a loopback or link-local address")
+
+const (
+	EVENT_BATCH_COMPLETED = "batch.completed"
+
+	DEFAULT_WEBHOOK_RETRY_MAX_DELAY = 5 * time.Minute
+
+	WebhookSubscriptionCollection = "webhookSubscriptions"
+	WebhookDeadLetterCollection   = "webhookDeadLetters"
+
+	HeaderWebhookEvent     = "X-Webhook-Event"
+	HeaderWebhookDelivery  = "X-Webhook-Delivery"
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+// WebhookSubscription only receives the events of the tenant of the request that created it.
+type WebhookSubscription struct {
+	ID         *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	URL        string              `bson:"url" json:"url"`
+	EventTypes []string            `bson:"eventTypes" json:"eventTypes"`
+	Secret     string              `bson:"secret" json:"secret,omitempty"`
+	Tenant     string              `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	CreatedAt  time.Time           `bson:"createdAt" json:"createdAt"`
+}
+
+func (s WebhookSubscription) accept(eventType string) bool {
+	return slices.Contains(s.EventTypes, eventType) || slices.Contains(s.EventTypes, "*")
+}
+
+// DeadLetter is a delivery that failed webhookMaxAttempts times. It can be replayed from the admin API.
+type DeadLetter struct {
+	ID             *primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	SubscriptionID primitive.ObjectID  `bson:"subscriptionId" json:"subscriptionId"`
+	Tenant         string              `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	URL            string              `bson:"url" json:"url"`
+	EventType      string              `bson:"eventType" json:"eventType"`
+	Payload        string              `bson:"payload" json:"payload"`
+	Attempts       int                 `bson:"attempts" json:"attempts"`
+	LastError      string              `bson:"lastError" json:"lastError"`
+	CreatedAt      time.Time           `bson:"createdAt" json:"createdAt"`
+}
+
+// BatchCompletedEvent is sent when a batch was processed.
+type BatchCompletedEvent struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	BatchID       string    `json:"batchId"`
+	MatchedCount  int64     `json:"matchedCount"`
+	ModifiedCount int64     `json:"modifiedCount"`
+	Time          time.Time `json:"time"`
+}
+
+type webhookDelivery struct {
+	id           string
+	subscription WebhookSubscription
+	eventType    string
+	payload      []byte
+	attempts     int
+}
+
+// signWebhook returns the value of the X-Webhook-Signature header: t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">.
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher delivers the events to the subscriptions in background. A failed delivery is retried with
+// an exponential backoff and moved to the dead letters after maxAttempts.
+type webhookDispatcher struct {
+	store WebhookStore
+	queue chan webhookDelivery
+	// allowLoopback lets the deliveries reach loopback and link-local addresses, they are refused otherwise
+	allowLoopback bool
+
+	mu sync.Mutex
+	// client, maxAttempts and retry can be changed by a config reload
+	client      *http.Client
+	maxAttempts int
+	retry       backoff
+
+	// subscriptions is the snapshot read by Dispatch, reloaded every refreshInterval and after each change
+	subscriptions   atomic.Pointer[[]WebhookSubscription]
+	refreshMu       sync.Mutex
+	refreshInterval time.Duration
+}
+
+func newWebhookDispatcher(store WebhookStore, maxAttempts int, retryDelay time.Duration, retryMaxDelay time.Duration, timeout time.Duration) *webhookDispatcher {
+	d := &webhookDispatcher{store: store, queue: make(chan webhookDelivery, 1000), refreshInterval: 5 * time.Second}
+	d.configure(maxAttempts, retryDelay, retryMaxDelay, timeout)
+	return d
+}
+
+// isLocalAddress is true for the addresses of the server itself and of its network link, that the webhooks can't
+// target (e.g. the metadata server of the cloud provider).
+func isLocalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkTarget refuses the urls whose host is a local address, the names are checked again once resolved.
+func (d *webhookDispatcher) checkTarget(u *url.URL) error {
+	if d.allowLoopback {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && isLocalAddress(ip)) || strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, host)
+	}
+	return nil
+}
+
+// newClient returns a client that can't connect to the local addresses, even through a name that resolves to one.
+func (d *webhookDispatcher) newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dialer.Control = func(network string, address string, conn syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip != nil && isLocalAddress(ip) && !d.allowLoopback {
+			return fmt.Errorf("%w: %s", ErrForbiddenTarget, host)
+		}
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// configure changes the delivery settings, the deliveries in progress keep the previous ones.
+func (d *webhookDispatcher) configure(maxAttempts int, retryDelay time.Duration, retryMaxDelay time.Duration, timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.client = d.newClient(timeout)
+	d.maxAttempts = max(maxAttempts, 1)
+	d.retry = backoff{initial: retryDelay, max: retryMaxDelay}
+}
+
+func (d *webhookDispatcher) settings() (*http.Client, int, backoff) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.client, d.maxAttempts, d.retry
+}
+
+// Start loads the subscriptions, then runs the delivery workers and the refresh of the subscriptions until ctx is done.
+func (d *webhookDispatcher) Start(ctx context.Context, workers int) {
+	if err := d.refresh(ctx); err != nil {
+		myLogger.For("webhook").Error().Msgf("[Webhook] Could not load subscriptions: %s", err.Error())
+	}
+	go func() {
+		// The subscriptions can also change through the other instances
+		ticker := time.NewTicker(d.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := d.refresh(ctx); err != nil {
+					myLogger.For("webhook").Error().Msgf("[Webhook] Could not reload subscriptions: %s", err.Error())
+				}
+			}
+		}
+	}()
+	for range max(workers, 1) {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-d.queue:
+					d.deliver(ctx, delivery)
+				}
+			}
+		}()
+	}
+}
+
+// refresh replaces the snapshot of the subscriptions, the previous one is kept if the store fails.
+func (d *webhookDispatcher) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	// Loaded one at a time, so an older list never replaces a newer one
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	subscriptions, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	d.subscriptions.Store(&subscriptions)
+	return nil
+}
+
+// Dispatch queues the event of tenant for every subscription of this tenant interested in eventType. It only reads
+// the snapshot of the subscriptions, and does nothing on a nil dispatcher.
+func (d *webhookDispatcher) Dispatch(tenant string, eventType string, event any) {
+	if d == nil {
+		return
+	}
+	subscriptions := d.subscriptions.Load()
+	if subscriptions == nil {
+		return
+	}
+
+	var payload []byte
+	var err error
+	for _, subscription := range *subscriptions {
+		if subscription.Tenant != tenant || !subscription.accept(eventType) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(event); err != nil {
+				myLogger.For("webhook").Error().Msgf("[Webhook] Could not serialize event %s: %s", eventType, err.Error())
+				return
+			}
+		}
+		d.enqueue(webhookDelivery{id: primitive.NewObjectID().Hex(), subscription: subscription, eventType: eventType, payload: payload})
+	}
+}
+
+func (d *webhookDispatcher) enqueue(delivery webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		// Saved in background, the requests that dispatch don't wait for the store
+		go d.deadLetter(delivery, errors.New("delivery queue is full"))
+	}
+}
+
+func (d *webhookDispatcher) send(ctx context.Context, delivery webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.subscription.URL, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookEvent, delivery.eventType)
+	req.Header.Set(HeaderWebhookDelivery, delivery.id)
+	req.Header.Set(HeaderWebhookSignature, signWebhook(delivery.subscription.Secret, time.Now(), delivery.payload))
+
+	client, _, _ := d.settings()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery webhookDelivery) {
+	delivery.attempts++
+	err := d.send(ctx, delivery)
+	if err == nil {
+		myLogger.For("webhook").Debug().Msgf("[Webhook] Delivery %s (%s) to %s was ok", delivery.id, delivery.eventType, delivery.subscription.URL)
+		return
+	}
+
+	_, maxAttempts, retry := d.settings()
+	if delivery.attempts >= maxAttempts {
+		d.deadLetter(delivery, err)
+		return
+	}
+
+	backoff := retry.delay(delivery.attempts)
+	myLogger.For("webhook").Warn().Msgf("[Webhook] Delivery %s attempt %d/%d failed: %s. Retry in %s", delivery.id, delivery.attempts, maxAttempts, err.Error(), backoff)
+	time.AfterFunc(backoff, func() {
+		if ctx.Err() == nil {
+			d.enqueue(delivery)
+		}
+	})
+}
+
+func (d *webhookDispatcher) deadLetter(delivery webhookDelivery, cause error) {
+	myLogger.For("webhook").Error().Msgf("[Webhook] Delivery %s (%s) to %s moved to dead letters after %d attempts: %s", delivery.id, delivery.eventType, delivery.subscription.URL, delivery.attempts, cause.Error())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	deadLetter := DeadLetter{
+		SubscriptionID: *delivery.subscription.ID,
+		Tenant:         delivery.subscription.Tenant,
+		URL:            delivery.subscription.URL,
+		EventType:      delivery.eventType,
+		Payload:        string(delivery.payload),
+		Attempts:       delivery.attempts,
+		LastError:      cause.Error(),
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := d.store.InsertDeadLetter(ctx, &deadLetter); err != nil {
+		myLogger.For("webhook").Error().Msgf("[Webhook] Could not save dead letter of delivery %s: %s", delivery.id, err.Error())
+	}
+}
+
+// Replay queues the dead letter of the tenant of ctx again (with a fresh attempt count) and removes it from the dead
+// letters.
+func (d *webhookDispatcher) Replay(ctx context.Context, id primitive.ObjectID) error {
+	deadLetter, err := d.store.FindDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if deadLetter.Tenant != tenantFrom(ctx) {
+		return fmt.Errorf("%w: dead letter %s", ErrNotFound, id.Hex())
+	}
+
+	subscriptions, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	index := slices.IndexFunc(subscriptions, func(s WebhookSubscription) bool { return *s.ID == deadLetter.SubscriptionID })
+	if index < 0 {
+		return fmt.Errorf("%w: subscription %s was deleted", ErrNotFound, deadLetter.SubscriptionID.Hex())
+	}
+
+	if err := d.store.DeleteDeadLetter(ctx, id); err != nil {
+		return err
+	}
+	d.enqueue(webhookDelivery{id: primitive.NewObjectID().Hex(), subscription: subscriptions[index], eventType: deadLetter.EventType, payload: []byte(deadLetter.Payload)})
+	return nil
+}
+
+func (s *serverContext) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var subscription WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(subscription.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "Error: url must be an absolute http(s) url", http.StatusBadRequest)
+		return
+	}
+	if err := s.webhooks.checkTarget(u); err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(subscription.EventTypes) == 0 {
+		http.Error(w, "Error: eventTypes can't be empty", http.StatusBadRequest)
+		return
+	}
+	if subscription.Secret == "" {
+		http.Error(w, "Error: secret can't be empty", http.StatusBadRequest)
+		return
+	}
+	id := primitive.NewObjectID()
+	subscription.ID = &id
+	subscription.Tenant = tenantFrom(r.Context())
+	subscription.CreatedAt = time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.runtime().writeTimeout)
+	defer cancel()
+
+	if err := s.webhooks.store.InsertSubscription(ctx, &subscription); err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.webhooks.refresh(r.Context()); err != nil {
+		myLogger.For("webhook").Error().Msgf("[Webhook] Could not reload subscriptions: %s", err.Error())
+	}
+	myLogger.For("webhook").Info().Msgf("[Webhook] Subscription %s created for %v -> %s", id.Hex(), subscription.EventTypes, subscription.URL)
+
+	subscription.Secret = ""
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+func (s *serverContext) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.runtime().readTimeout)
+	defer cancel()
+
+	subscriptions, err := s.webhooks.store.ListSubscriptions(ctx)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tenant := tenantFrom(r.Context())
+	subscriptions = slices.DeleteFunc(subscriptions, func(subscription WebhookSubscription) bool { return subscription.Tenant != tenant })
+	// Secrets are never sent back
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+func (s *serverContext) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.runtime().writeTimeout)
+	defer cancel()
+
+	// The subscriptions of the other tenants don't exist for this one
+	subscriptions, err := s.webhooks.store.ListSubscriptions(ctx)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tenant := tenantFrom(r.Context())
+	if !slices.ContainsFunc(subscriptions, func(subscription WebhookSubscription) bool {
+		return *subscription.ID == id && subscription.Tenant == tenant
+	}) {
+		http.Error(w, "Error: "+ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.webhooks.store.DeleteSubscription(ctx, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.webhooks.refresh(r.Context()); err != nil {
+		myLogger.For("webhook").Error().Msgf("[Webhook] Could not reload subscriptions: %s", err.Error())
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *serverContext) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.runtime().readTimeout)
+	defer cancel()
+
+	deadLetters, err := s.webhooks.store.ListDeadLetters(ctx)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tenant := tenantFrom(r.Context())
+	deadLetters = slices.DeleteFunc(deadLetters, func(deadLetter DeadLetter) bool { return deadLetter.Tenant != tenant })
+	json.NewEncoder(w).Encode(deadLetters)
+}
+
+func (s *serverContext) replayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.runtime().writeTimeout)
+	defer cancel()
+
+	if err := s.webhooks.Replay(ctx, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
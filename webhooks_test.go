@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     bool
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	if r.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (r *webhookReceiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for: %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testWebhooks(t *testing.T, factory storeFactory) {
+	url := newTestServer(t, factory)
+	receiver := &webhookReceiver{}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+
+	resp, body := doRequestWithHeader(t, http.MethodPost, url+"/admin/webhooks", WebhookSubscription{URL: receiverServer.URL}, adminHeader)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	secret := "mySecret"
+	resp, body = doRequestWithHeader(t, http.MethodPost, url+"/admin/webhooks", WebhookSubscription{URL: receiverServer.URL, EventTypes: []string{"document.verified", EVENT_BATCH_COMPLETED}, Secret: secret}, adminHeader)
+	expectStatus(t, resp, body, http.StatusCreated)
+	var subscription WebhookSubscription
+	if err := json.Unmarshal(body, &subscription); err != nil || subscription.ID == nil || subscription.Secret != "" {
+		t.Fatalf("expected: a subscription with an id and without secret, got: %s", body)
+	}
+
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/admin/webhooks", nil, adminHeader)
+	expectStatus(t, resp, body, http.StatusOK)
+	var subscriptions []WebhookSubscription
+	if err := json.Unmarshal(body, &subscriptions); err != nil || len(subscriptions) != 1 || subscriptions[0].Secret != "" {
+		t.Fatalf("expected: 1 subscription without secret, got: %s", body)
+	}
+
+	// Rejected is not subscribed, verified is
+	for _, key := range []string{"key1", "key2"} {
+		resp, body = doRequest(t, http.MethodPost, url+"/save", MyDocument{Name: "name", Key: key})
+		expectStatus(t, resp, body, http.StatusOK)
+	}
+	doRequest(t, http.MethodPut, url+"/update/key1/rejected", nil)
+	doRequest(t, http.MethodPut, url+"/update/key2/verified", nil)
+	waitFor(t, "verified delivery", func() bool { return receiver.count() == 1 })
+
+	receiver.mu.Lock()
+	req, payload := receiver.requests[0], receiver.bodies[0]
+	receiver.mu.Unlock()
+	if req.Header.Get(HeaderWebhookEvent) != "document.verified" {
+		t.Fatalf("expected: event document.verified, got: %s", req.Header.Get(HeaderWebhookEvent))
+	}
+	var event StateChangeEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.Key != "key2" || event.State != STATE_VERIFIED {
+		t.Fatalf("unexpected payload: %s", payload)
+	}
+	signature := req.Header.Get(HeaderWebhookSignature)
+	var timestamp int64
+	var mac string
+	if _, err := fmt.Sscanf(signature, "t=%d,v1=%s", &timestamp, &mac); err != nil || signature != signWebhook(secret, time.Unix(timestamp, 0), payload) {
+		t.Fatalf("invalid signature: %s", signature)
+	}
+
+	// A failing receiver ends in the dead letters after 3 attempts
+	receiver.mu.Lock()
+	receiver.fail = true
+	receiver.mu.Unlock()
+
+	resp, body = doRequest(t, http.MethodPost, url+"/batch/save", MyDocumentList{ToProcess: []MyDocument{{Key: "key2"}}})
+	expectStatus(t, resp, body, http.StatusOK)
+	var batchId MyDocumentId
+	json.Unmarshal(body, &batchId)
+	resp, body = doRequest(t, http.MethodPut, url+"/process/"+batchId.ID.Hex(), nil)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	var deadLetters []DeadLetter
+	waitFor(t, "dead letter", func() bool {
+		_, body := doRequestWithHeader(t, http.MethodGet, url+"/admin/webhooks/deadletters", nil, adminHeader)
+		json.Unmarshal(body, &deadLetters)
+		return len(deadLetters) == 1
+	})
+	if receiver.count() != 4 || deadLetters[0].Attempts != 3 || deadLetters[0].EventType != EVENT_BATCH_COMPLETED {
+		t.Fatalf("expected: 3 failed attempts of %s, got: %d requests and %+v", EVENT_BATCH_COMPLETED, receiver.count(), deadLetters[0])
+	}
+
+	// Replay once the receiver is back
+	receiver.mu.Lock()
+	receiver.fail = false
+	receiver.mu.Unlock()
+
+	resp, body = doRequestWithHeader(t, http.MethodPost, url+"/admin/webhooks/deadletters/"+deadLetters[0].ID.Hex()+"/replay", nil, adminHeader)
+	expectStatus(t, resp, body, http.StatusAccepted)
+	waitFor(t, "replayed delivery", func() bool { return receiver.count() == 5 })
+
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/admin/webhooks/deadletters", nil, adminHeader)
+	json.Unmarshal(body, &deadLetters)
+	if len(deadLetters) != 0 {
+		t.Fatalf("expected: no dead letter after replay, got: %s", body)
+	}
+
+	resp, body = doRequestWithHeader(t, http.MethodDelete, url+"/admin/webhooks/"+subscription.ID.Hex(), nil, adminHeader)
+	expectStatus(t, resp, body, http.StatusNoContent)
+	resp, body = doRequestWithHeader(t, http.MethodDelete, url+"/admin/webhooks/"+subscription.ID.Hex(), nil, adminHeader)
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestWebhookAdminSecurity(t *testing.T) {
+	url := newTestServer(t, func(t *testing.T) Store { return newMemoryStore() })
+	subscription := WebhookSubscription{URL: "https://example.com/hook", EventTypes: []string{"*"}, Secret: "secret"}
+
+	resp, body := doRequest(t, http.MethodPost, url+"/admin/webhooks", subscription)
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+	resp, body = doRequestWithHeader(t, http.MethodGet, url+"/admin/webhooks", nil, http.Header{HEADER_ADMIN_TOKEN: {"wrong"}})
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+
+	// Without adminToken, nobody can use them
+	store := newMemoryStore()
+	ctx := &serverContext{documents: store, batches: store, webhooks: newWebhookDispatcher(store, 1, time.Millisecond, time.Second, 5*time.Second), events: newEventBroker(1)}
+	server := httptest.NewServer(ctx.MainServer(true))
+	defer server.Close()
+	resp, body = doRequestWithHeader(t, http.MethodGet, server.URL+"/admin/webhooks", nil, http.Header{HEADER_ADMIN_TOKEN: {""}})
+	expectStatus(t, resp, body, http.StatusForbidden)
+}
+
+func TestWebhookLocalTargets(t *testing.T) {
+	store := newMemoryStore()
+	webhooks := newWebhookDispatcher(store, 1, time.Millisecond, time.Second, 5*time.Second)
+	for _, target := range []string{"http://127.0.0.1/hook", "http://localhost:8080/hook", "http://[::1]/hook", "http://169.254.169.254/latest/meta-data", "http://0.0.0.0/hook"} {
+		u, _ := neturl.Parse(target)
+		if err := webhooks.checkTarget(u); !errors.Is(err, ErrForbiddenTarget) {
+			t.Fatalf("expected: error %v for %s, got: %v", ErrForbiddenTarget, target, err)
+		}
+	}
+	if u, _ := neturl.Parse("https://example.com/hook"); webhooks.checkTarget(u) != nil {
+		t.Fatalf("expected: example.com allowed")
+	}
+
+	// The connections are checked too, for the names that resolve to a local address
+	receiver := &webhookReceiver{}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+	id := primitive.NewObjectID()
+	delivery := webhookDelivery{id: "id", subscription: WebhookSubscription{ID: &id, URL: receiverServer.URL, Secret: "secret"}, eventType: "document.verified", payload: []byte("{}")}
+	if err := webhooks.send(context.Background(), delivery); !errors.Is(err, ErrForbiddenTarget) || receiver.count() != 0 {
+		t.Fatalf("expected: error %v and no request, got: %v and %d requests", ErrForbiddenTarget, err, receiver.count())
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	webhooks := newWebhookDispatcher(newMemoryStore(), 1000, time.Second, time.Minute, time.Second)
+	_, _, retry := webhooks.settings()
+	// Without the cap, 1s << 63 would overflow
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 7: time.Minute, 64: time.Minute, 999: time.Minute} {
+		if delay := retry.delay(attempt); delay != expected {
+			t.Fatalf("expected: %s after attempt %d, got: %s", expected, attempt, delay)
+		}
+	}
+}
+
+// countingWebhookStore counts the loads of the subscriptions.
+type countingWebhookStore struct {
+	*memoryStore
+	loads atomic.Int32
+}
+
+func (s *countingWebhookStore) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	s.loads.Add(1)
+	return s.memoryStore.ListSubscriptions(ctx)
+}
+
+func TestWebhookDispatchReadsSnapshot(t *testing.T) {
+	receiver := &webhookReceiver{}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+	store := &countingWebhookStore{memoryStore: newMemoryStore()}
+	id := primitive.NewObjectID()
+	if err := store.InsertSubscription(context.Background(), &WebhookSubscription{ID: &id, URL: receiverServer.URL, EventTypes: []string{"*"}, Secret: "secret"}); err != nil {
+		t.Fatalf("Could not insert subscription: %v", err)
+	}
+	webhooks := newWebhookDispatcher(store, 1, time.Millisecond, time.Second, 5*time.Second)
+	webhooks.allowLoopback = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	webhooks.Start(ctx, 1)
+
+	for range 10 {
+		webhooks.Dispatch("", "document.verified", StateChangeEvent{Key: "key1"})
+	}
+	if loads := store.loads.Load(); loads != 1 {
+		t.Fatalf("expected: subscriptions loaded once at start, got: %d loads", loads)
+	}
+}